@@ -0,0 +1,216 @@
+// Package admin provides an http.Handler exposing JSON endpoints to inspect
+// and invalidate the cache of a httpcache.Transport:
+//
+//	GET  /entry?url=<url>     the cached responses for url
+//	GET  /explain?url=<url>   how the cached response for url is treated,
+//	                          see httpcache.Explain
+//	POST /purge?url=<url>     remove the cached responses for url, or mark
+//	                          them stale with soft=1
+//	POST /purge?prefix=<url>  remove the cached responses for URLs starting
+//	                          with prefix
+//	POST /purge?tag=<tag>     remove the cached responses tagged with tag
+//	GET  /stats               the Transport counters and the cache size
+//
+// The handler expects the paths above; mount it under another path with
+// http.StripPrefix. It gives full control over the cache, so it must only be
+// reachable by operators.
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mchtech/httpcache"
+)
+
+// Entry is the JSON form of a httpcache.EntryInfo.
+type Entry struct {
+	Key         string      `json:"key"`
+	Method      string      `json:"method,omitempty"`
+	URL         string      `json:"url"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	StoredAt    *time.Time  `json:"storedAt,omitempty"`
+	Age         float64     `json:"age"`
+	TTL         float64     `json:"ttl"`
+	Freshness   string      `json:"freshness"`
+	Size        int         `json:"size"`
+	Tags        []string    `json:"tags,omitempty"`
+	Invalidated bool        `json:"invalidated,omitempty"`
+}
+
+// Explanation is the JSON form of a httpcache.Explanation.
+type Explanation struct {
+	Cacheable      bool     `json:"cacheable"`
+	Storable       bool     `json:"storable"`
+	Reasons        []string `json:"reasons,omitempty"`
+	Lifetime       float64  `json:"lifetime"`
+	LifetimeSource string   `json:"lifetimeSource"`
+	Age            float64  `json:"age"`
+	Freshness      string   `json:"freshness"`
+	Directives     []string `json:"directives,omitempty"`
+	StaleIfError   bool     `json:"staleIfError,omitempty"`
+	Next           string   `json:"next"`
+}
+
+// Stats is the JSON form of the /stats response. Entries and Size are
+// omitted if the Cache isn't a httpcache.Sizer.
+type Stats struct {
+	Requests       uint64 `json:"requests"`
+	Hits           uint64 `json:"hits"`
+	Stores         uint64 `json:"stores"`
+	CorruptEntries uint64 `json:"corruptEntries"`
+	Bans           int    `json:"bans"`
+	Entries        *int   `json:"entries,omitempty"`
+	Size           *int64 `json:"size,omitempty"`
+}
+
+// PurgeResult is the JSON form of the /purge response.
+type PurgeResult struct {
+	Purged int `json:"purged"`
+}
+
+type handler struct {
+	t   *httpcache.Transport
+	mux *http.ServeMux
+}
+
+// New returns a handler administering the cache of t.
+func New(t *httpcache.Transport) http.Handler {
+	h := &handler{t: t, mux: http.NewServeMux()}
+	h.mux.HandleFunc("GET /entry", h.entry)
+	h.mux.HandleFunc("GET /explain", h.explain)
+	h.mux.HandleFunc("POST /purge", h.purge)
+	h.mux.HandleFunc("GET /stats", h.stats)
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *handler) entry(w http.ResponseWriter, r *http.Request) {
+	rawurl := r.URL.Query().Get("url")
+	if rawurl == "" {
+		writeError(w, http.StatusBadRequest, "missing url parameter")
+		return
+	}
+	infos := h.t.Inspect(rawurl)
+	if len(infos) == 0 {
+		writeError(w, http.StatusNotFound, "not cached")
+		return
+	}
+	entries := make([]Entry, len(infos))
+	for i, info := range infos {
+		entries[i] = Entry{
+			Key:         info.Key,
+			Method:      info.Method,
+			URL:         info.URL,
+			Status:      info.StatusCode,
+			Header:      info.Header,
+			Age:         info.Age.Seconds(),
+			TTL:         info.TTL.Seconds(),
+			Freshness:   info.Freshness,
+			Size:        info.Size,
+			Tags:        info.Tags,
+			Invalidated: info.Invalidated,
+		}
+		if !info.StoredAt.IsZero() {
+			entries[i].StoredAt = &info.StoredAt
+		}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// explain explains the cached response to a GET of url, as it would be used
+// for another such request without validators.
+func (h *handler) explain(w http.ResponseWriter, r *http.Request) {
+	rawurl := r.URL.Query().Get("url")
+	if rawurl == "" {
+		writeError(w, http.StatusBadRequest, "missing url parameter")
+		return
+	}
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp, err := httpcache.CachedResponse(h.t.Cache, req)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if resp == nil {
+		writeError(w, http.StatusNotFound, "not cached")
+		return
+	}
+	resp.Body.Close()
+	e := httpcache.Explain(req, resp)
+	writeJSON(w, http.StatusOK, Explanation{
+		Cacheable:      e.Cacheable,
+		Storable:       e.Storable,
+		Reasons:        e.Reasons,
+		Lifetime:       e.Lifetime.Seconds(),
+		LifetimeSource: e.LifetimeSource,
+		Age:            e.Age.Seconds(),
+		Freshness:      e.Freshness,
+		Directives:     e.Directives,
+		StaleIfError:   e.StaleIfError,
+		Next:           e.Next,
+	})
+}
+
+func (h *handler) purge(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var n int
+	switch {
+	case q.Get("url") != "":
+		if soft, _ := strconv.ParseBool(q.Get("soft")); soft {
+			n = h.t.SoftPurgeURL(q.Get("url"))
+		} else {
+			n = h.t.PurgeURL(q.Get("url"))
+		}
+	case q.Get("prefix") != "":
+		var err error
+		if n, err = h.t.PurgePrefix(q.Get("prefix")); err != nil {
+			writeError(w, http.StatusNotImplemented, err.Error())
+			return
+		}
+	case q.Get("tag") != "":
+		n = h.t.PurgeTag(q.Get("tag"))
+	default:
+		writeError(w, http.StatusBadRequest, "missing url, prefix or tag parameter")
+		return
+	}
+	writeJSON(w, http.StatusOK, PurgeResult{Purged: n})
+}
+
+func (h *handler) stats(w http.ResponseWriter, r *http.Request) {
+	s := h.t.Stats()
+	stats := Stats{
+		Requests:       s.Requests,
+		Hits:           s.Hits,
+		Stores:         s.Stores,
+		CorruptEntries: s.CorruptEntries,
+		Bans:           len(h.t.Bans()),
+	}
+	if sizer, ok := h.t.Cache.(httpcache.Sizer); ok {
+		n, size := sizer.Len(), sizer.Size()
+		stats.Entries, stats.Size = &n, &size
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{msg})
+}
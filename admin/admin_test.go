@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mchtech/httpcache"
+)
+
+func TestAdmin(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().UTC().Format(time.RFC1123))
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Etag", `"etag"`)
+		w.Header().Set("Surrogate-Key", "page"+r.URL.Path[1:])
+		w.Write([]byte("body"))
+	}))
+	defer origin.Close()
+
+	tp := httpcache.NewTransport(httpcache.NewMemoryCache())
+	tp.TagIndex = httpcache.NewMemoryCache()
+	client := tp.Client()
+	for _, path := range []string{"/a", "/b", "/c"} {
+		resp, err := client.Get(origin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	admin := httptest.NewServer(New(tp))
+	defer admin.Close()
+	call := func(method, path string, status int, v interface{}) {
+		req, _ := http.NewRequest(method, admin.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: status %d, want %d", method, path, resp.StatusCode, status)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var entries []Entry
+	call("GET", "/entry?url="+origin.URL+"/a", http.StatusOK, &entries)
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.Status != http.StatusOK || e.Freshness != "fresh" || e.TTL < 3500 || e.StoredAt == nil || e.Size == 0 {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if len(e.Tags) != 1 || e.Tags[0] != "pagea" || e.Header.Get("Etag") != `"etag"` {
+		t.Fatalf("unexpected tags or headers %+v", e)
+	}
+	call("GET", "/entry?url="+origin.URL+"/missing", http.StatusNotFound, nil)
+	call("GET", "/entry", http.StatusBadRequest, nil)
+
+	var explanation Explanation
+	call("GET", "/explain?url="+origin.URL+"/a", http.StatusOK, &explanation)
+	if !explanation.Storable || explanation.Lifetime != 3600 || explanation.LifetimeSource != httpcache.LifetimeMaxAge ||
+		explanation.Next != httpcache.ActionRevalidate {
+		t.Fatalf("unexpected explanation %+v", explanation)
+	}
+	call("GET", "/explain?url="+origin.URL+"/missing", http.StatusNotFound, nil)
+
+	var result PurgeResult
+	call("POST", "/purge?soft=1&url="+origin.URL+"/a", http.StatusOK, &result)
+	call("GET", "/entry?url="+origin.URL+"/a", http.StatusOK, &entries)
+	if result.Purged != 1 || !entries[0].Invalidated || entries[0].Freshness != "stale" {
+		t.Fatalf("soft purge: %+v, %+v", result, entries[0])
+	}
+	call("POST", "/purge?url="+origin.URL+"/a", http.StatusOK, &result)
+	if result.Purged != 1 {
+		t.Fatalf("purged %d entries by URL, want 1", result.Purged)
+	}
+	call("POST", "/purge?tag=pageb", http.StatusOK, &result)
+	if result.Purged != 1 {
+		t.Fatalf("purged %d entries by tag, want 1", result.Purged)
+	}
+	call("POST", "/purge?prefix="+origin.URL+"/", http.StatusOK, &result)
+	if result.Purged != 1 {
+		t.Fatalf("purged %d entries by prefix, want 1", result.Purged)
+	}
+	call("POST", "/purge", http.StatusBadRequest, nil)
+
+	var stats Stats
+	call("GET", "/stats", http.StatusOK, &stats)
+	if stats.Requests != 3 || stats.Stores != 3 || stats.Entries == nil || stats.Size == nil {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
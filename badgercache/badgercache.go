@@ -1,17 +1,63 @@
+// Package badgercache provides an implementation of httpcache.Cache that
+// uses github.com/dgraph-io/badger/v2
 package badgercache
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 	"io/ioutil"
+	"sync"
+	"time"
 
 	badger "github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/options"
+	"github.com/mchtech/httpcache"
 )
 
+// Options configures a Cache opened with NewWithOptions.
+type Options struct {
+	// Dir is the directory badger stores its files in. It is ignored when
+	// InMemory is set.
+	Dir string
+	// InMemory keeps the database in memory only; nothing is written to disk.
+	InMemory bool
+	// Compression is the block compression badger applies to its tables.
+	Compression options.CompressionType
+	// StaleTTL is how long an entry is kept after it stops being fresh, so
+	// that it can still be revalidated with the origin. Entries are stored
+	// without an expiry when StaleTTL is zero.
+	StaleTTL time.Duration
+	// GCInterval is how often the value log is garbage collected. Zero
+	// disables the background garbage collection.
+	GCInterval time.Duration
+	// GCDiscardRatio is passed to badger's RunValueLogGC.
+	GCDiscardRatio float64
+	// Logger receives the errors of the cache and of badger itself. If nil,
+	// nothing is logged.
+	Logger badger.Logger
+}
+
+// DefaultOptions returns the Options used by New for a database in dir.
+func DefaultOptions(dir string) Options {
+	return Options{
+		Dir:            dir,
+		Compression:    options.Snappy,
+		StaleTTL:       24 * time.Hour,
+		GCInterval:     10 * time.Minute,
+		GCDiscardRatio: 0.5,
+	}
+}
+
 // Cache is an implementation of httpcache.Cache with badger storage
 type Cache struct {
-	db *badger.DB
+	db   *badger.DB
+	opts Options
+	// ownDB is set when the cache opened db itself and must close it.
+	ownDB bool
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
 }
 
 // Has returns whether key has been cached
@@ -26,7 +72,7 @@ func (c *Cache) Has(key string) (ok bool) {
 
 // Get returns the response corresponding to key if present
 func (c *Cache) Get(key string) (resp io.ReadCloser, ok bool) {
-	c.db.View(func(txn *badger.Txn) (err error) {
+	err := c.db.View(func(txn *badger.Txn) (err error) {
 		var item *badger.Item
 		item, err = txn.Get([]byte(key))
 		if err != nil {
@@ -40,43 +86,195 @@ func (c *Cache) Get(key string) (resp io.ReadCloser, ok bool) {
 		ok = true
 		return
 	})
+	if err != nil && err != badger.ErrKeyNotFound {
+		c.errorf("badgercache: get %q: %v", key, err)
+	}
 	return
 }
 
 // Set saves a response to the cache as key
 func (c *Cache) Set(key string, resp io.ReadCloser) {
-	err := c.db.Update(func(txn *badger.Txn) error {
-		data, err := ioutil.ReadAll(resp)
-		if err != nil {
-			return err
-		}
-		return txn.Set([]byte(key), data)
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		c.errorf("badgercache: read %q: %v", key, err)
+		return
+	}
+	entry := badger.NewEntry([]byte(key), data)
+	if ttl := c.ttl(data); ttl > 0 {
+		entry = entry.WithTTL(ttl)
+	}
+	err = c.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(entry)
 	})
-	fmt.Println(err)
+	if err != nil {
+		c.errorf("badgercache: set %q: %v", key, err)
+	}
 }
 
 // Delete removes the response with key from the cache
 func (c *Cache) Delete(key string) {
-	c.db.Update(func(txn *badger.Txn) error {
+	err := c.db.Update(func(txn *badger.Txn) error {
 		return txn.Delete([]byte(key))
 	})
+	if err != nil {
+		c.errorf("badgercache: delete %q: %v", key, err)
+	}
+}
+
+// Keys returns the keys of all entries that start with prefix
+func (c *Cache) Keys(prefix string) (keys []string) {
+	c.scan(prefix, func(item *badger.Item) {
+		keys = append(keys, string(item.Key()))
+	})
+	return
+}
+
+// PurgePrefix removes all entries whose key starts with prefix and returns how
+// many were removed
+func (c *Cache) PurgePrefix(prefix string) (n int) {
+	keys := c.Keys(prefix)
+	wb := c.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range keys {
+		if err := wb.Delete([]byte(key)); err != nil {
+			c.errorf("badgercache: purge %q: %v", prefix, err)
+			return 0
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		c.errorf("badgercache: purge %q: %v", prefix, err)
+		return 0
+	}
+	return len(keys)
+}
+
+// Len returns the number of entries
+func (c *Cache) Len() (n int) {
+	c.scan("", func(*badger.Item) {
+		n++
+	})
+	return
+}
+
+// Size returns the total size of the keys and entries in bytes
+func (c *Cache) Size() (size int64) {
+	c.scan("", func(item *badger.Item) {
+		size += int64(len(item.Key())) + item.ValueSize()
+	})
+	return
+}
+
+// scan calls fn for every live entry whose key starts with prefix, without
+// fetching values.
+func (c *Cache) scan(prefix string, fn func(item *badger.Item)) {
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			fn(it.Item())
+		}
+		return nil
+	})
+	if err != nil {
+		c.errorf("badgercache: scan %q: %v", prefix, err)
+	}
+}
+
+// Close stops the background garbage collection and, if the database was
+// opened by New or NewWithOptions, closes it.
+func (c *Cache) Close() (err error) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.wg.Wait()
+		if c.ownDB {
+			err = c.db.Close()
+		}
+	})
+	return
+}
+
+// ttl returns how long the entry data should be kept, or zero if it should
+// not expire. Responses without a Date are considered stale right away.
+func (c *Cache) ttl(data []byte) time.Duration {
+	if c.opts.StaleTTL <= 0 {
+		return 0
+	}
+	ttl := c.opts.StaleTTL
+	if resp, err := httpcache.ReadEntryHeader(bytes.NewReader(data)); err == nil {
+		if expires, ok := httpcache.ExpiresAt(resp.Header); ok {
+			if fresh := time.Until(expires); fresh > 0 {
+				ttl += fresh
+			}
+		}
+	}
+	return ttl
+}
+
+// runGC periodically garbage collects the value log until the cache is closed.
+func (c *Cache) runGC() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.opts.GCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		// A successful run may leave more to collect, so repeat until badger
+		// reports there was nothing to rewrite.
+		for {
+			err := c.db.RunValueLogGC(c.opts.GCDiscardRatio)
+			if err == nil {
+				continue
+			}
+			if err != badger.ErrNoRewrite && err != badger.ErrRejected {
+				c.errorf("badgercache: value log gc: %v", err)
+			}
+			break
+		}
+	}
+}
+
+func (c *Cache) errorf(format string, args ...interface{}) {
+	if c.opts.Logger != nil {
+		c.opts.Logger.Errorf(format, args...)
+	}
 }
 
 // New returns a new Cache that will store badger in path
 func New(path string) (*Cache, error) {
-	cache := &Cache{}
-
-	var err error
-	cache.db, err = badger.Open(badger.DefaultOptions(path))
+	return NewWithOptions(DefaultOptions(path))
+}
 
+// NewWithOptions opens a badger database configured by opts and returns a
+// Cache using it. The Cache must be closed with Close.
+func NewWithOptions(opts Options) (*Cache, error) {
+	bopts := badger.DefaultOptions(opts.Dir).
+		WithInMemory(opts.InMemory).
+		WithCompression(opts.Compression).
+		WithLogger(opts.Logger)
+	if opts.InMemory {
+		bopts = bopts.WithDir("").WithValueDir("")
+	}
+	db, err := badger.Open(bopts)
 	if err != nil {
 		return nil, err
 	}
+
+	cache := &Cache{db: db, opts: opts, ownDB: true, done: make(chan struct{})}
+	if opts.GCInterval > 0 && !opts.InMemory {
+		cache.wg.Add(1)
+		go cache.runGC()
+	}
 	return cache, nil
 }
 
 // NewWithDB returns a new Cache using the provided badger as underlying
 // storage.
 func NewWithDB(db *badger.DB) *Cache {
-	return &Cache{db}
+	return &Cache{db: db, done: make(chan struct{})}
 }
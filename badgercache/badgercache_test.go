@@ -1,11 +1,14 @@
 package badgercache
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	badger "github.com/dgraph-io/badger/v2"
 	"github.com/mchtech/httpcache/test"
 )
 
@@ -20,6 +23,45 @@ func TestBadgerCache(t *testing.T) {
 	if err != nil {
 		t.Fatalf("New badgerdb,: %v", err)
 	}
+	defer cache.Close()
 
 	test.Cache(t, cache)
+	test.Manage(t, cache)
+}
+
+func TestBadgerCacheTTL(t *testing.T) {
+	opts := DefaultOptions("")
+	opts.InMemory = true
+	opts.StaleTTL = time.Hour
+	cache, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	defer cache.Close()
+
+	test.Cache(t, cache)
+
+	now := time.Now()
+	entry := "HTTP/1.1 200 OK\r\n" +
+		"Date: " + now.UTC().Format(time.RFC1123) + "\r\n" +
+		"Cache-Control: max-age=60\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	cache.Set("fresh", ioutil.NopCloser(bytes.NewReader([]byte(entry))))
+
+	var expiresAt time.Time
+	err = cache.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("fresh"))
+		if err != nil {
+			return err
+		}
+		expiresAt = time.Unix(int64(item.ExpiresAt()), 0)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := now.Add(time.Hour + time.Minute)
+	if d := expiresAt.Sub(want); d < -2*time.Second || d > 2*time.Second {
+		t.Fatalf("entry expires at %v, want about %v", expiresAt, want)
+	}
 }
@@ -0,0 +1,248 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Ban invalidates the cached responses that match its expression and were
+// stored before it was created, in the manner of Varnish bans.
+//
+// An expression is one or more conditions joined by "&&". Each condition
+// compares a field of the cached response with a value using one of the
+// operators == (equal), != (not equal), ~ (matches regular expression) and
+// !~ (doesn't match). The fields are:
+//
+//	req.url            the path and query of the request URL
+//	req.host           the host of the request URL
+//	req.method         the request method
+//	resp.status        the response status code
+//	resp.header.<name> the response header <name>
+//
+// Values may be quoted as Go strings. For example:
+//
+//	req.url ~ ^/api/v1/users
+//	req.host == example.com && resp.header.Content-Type == application/json
+type Ban struct {
+	Expr    string
+	Created time.Time
+}
+
+type ban struct {
+	Ban
+	conds []banCond
+}
+
+type banCond struct {
+	field string // header name for resp.header
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+var banCondRe = regexp.MustCompile(`^\s*(\S+?)\s*(==|!=|!~|~)\s*(.*?)\s*$`)
+
+// parseBan parses a ban expression.
+func parseBan(expr string) (*ban, error) {
+	b := &ban{Ban: Ban{Expr: expr}}
+	for _, clause := range strings.Split(expr, "&&") {
+		m := banCondRe.FindStringSubmatch(clause)
+		if m == nil {
+			return nil, fmt.Errorf("httpcache: invalid ban condition %q", strings.TrimSpace(clause))
+		}
+		c := banCond{field: m[1], op: m[2], value: m[3]}
+		switch {
+		case c.field == "req.url", c.field == "req.host", c.field == "req.method", c.field == "resp.status":
+		case strings.HasPrefix(c.field, "resp.header.") && len(c.field) > len("resp.header."):
+		default:
+			return nil, fmt.Errorf("httpcache: unknown ban field %q", c.field)
+		}
+		if strings.HasPrefix(c.value, `"`) {
+			v, err := strconv.Unquote(c.value)
+			if err != nil {
+				return nil, fmt.Errorf("httpcache: invalid ban value %s: %v", c.value, err)
+			}
+			c.value = v
+		}
+		if c.op == "~" || c.op == "!~" {
+			re, err := regexp.Compile(c.value)
+			if err != nil {
+				return nil, fmt.Errorf("httpcache: invalid ban regexp %q: %v", c.value, err)
+			}
+			c.re = re
+		}
+		b.conds = append(b.conds, c)
+	}
+	return b, nil
+}
+
+// matches reports whether the response stored as key with meta matches
+// every condition of b.
+func (b *ban) matches(key string, resp *http.Response, meta *entryMeta) bool {
+	rawurl, method := meta.URL, meta.Method
+	if rawurl == "" {
+		rawurl = KeyURL(key)
+		if method = http.MethodGet; rawurl != key {
+			method = strings.TrimSuffix(key[:len(key)-len(rawurl)], " ")
+		}
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	for _, c := range b.conds {
+		var v string
+		switch c.field {
+		case "req.url":
+			v = u.RequestURI()
+		case "req.host":
+			v = u.Host
+		case "req.method":
+			v = method
+		case "resp.status":
+			v = strconv.Itoa(resp.StatusCode)
+		default:
+			v = resp.Header.Get(strings.TrimPrefix(c.field, "resp.header."))
+		}
+		var ok bool
+		switch c.op {
+		case "==":
+			ok = v == c.value
+		case "!=":
+			ok = v != c.value
+		case "~":
+			ok = c.re.MatchString(v)
+		case "!~":
+			ok = !c.re.MatchString(v)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// bans holds the bans of a Transport.
+type bans struct {
+	mu   sync.RWMutex
+	list []*ban
+}
+
+// Ban adds a ban with the expression expr, described at Ban. The cached
+// responses it matches are treated as misses, and removed, when they are
+// next looked up or when Lurk runs.
+func (t *Transport) Ban(expr string) error {
+	b, err := parseBan(expr)
+	if err != nil {
+		return err
+	}
+	b.Created = time.Now()
+	t.bans.mu.Lock()
+	t.bans.list = append(t.bans.list, b)
+	t.bans.mu.Unlock()
+	return nil
+}
+
+// Bans returns the bans in effect, oldest first.
+func (t *Transport) Bans() []Ban {
+	t.bans.mu.RLock()
+	defer t.bans.mu.RUnlock()
+	list := make([]Ban, len(t.bans.list))
+	for i, b := range t.bans.list {
+		list[i] = b.Ban
+	}
+	return list
+}
+
+// banned reports whether a ban applies to the response stored as key with
+// meta.
+func (t *Transport) banned(key string, resp *http.Response, meta *entryMeta) bool {
+	t.bans.mu.RLock()
+	defer t.bans.mu.RUnlock()
+	for _, b := range t.bans.list {
+		if meta.StoredAt.Before(b.Created) && b.matches(key, resp, meta) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lurk removes the cached responses that a ban applies to and returns how
+// many were removed. It needs a Cache that is a Lister, and otherwise does
+// nothing. If the Cache is also a Sizer and the pass listed as many entries
+// as it holds, the bans older than the start of the pass have been applied
+// to every entry and are dropped; otherwise they are kept for the lazy check.
+func (t *Transport) Lurk() (n int) {
+	l, ok := t.Cache.(Lister)
+	if !ok {
+		return 0
+	}
+	t.bans.mu.RLock()
+	pending := len(t.bans.list)
+	t.bans.mu.RUnlock()
+	if pending == 0 {
+		return 0
+	}
+	start := time.Now()
+	keys := l.Keys("")
+	for _, key := range keys {
+		r, ok := t.Cache.Get(key)
+		if !ok {
+			continue
+		}
+		resp, meta, err := readEntryHeader(r)
+		r.Close()
+		if err == nil && t.banned(key, resp, meta) {
+			t.evict(key, EvictionBanned)
+			n++
+		}
+	}
+	if s, ok := t.Cache.(Sizer); !ok || len(keys)-n < s.Len() {
+		return n
+	}
+
+	t.bans.mu.Lock()
+	list := t.bans.list[:0]
+	for _, b := range t.bans.list {
+		if !b.Created.Before(start) {
+			list = append(list, b)
+		}
+	}
+	t.bans.list = list
+	t.bans.mu.Unlock()
+	return n
+}
+
+// StartLurker runs Lurk every interval in the background until the returned
+// function is called.
+func (t *Transport) StartLurker(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				t.Lurk()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
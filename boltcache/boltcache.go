@@ -0,0 +1,215 @@
+// Package boltcache provides an implementation of httpcache.Cache that
+// stores responses in a single file using go.etcd.io/bbolt
+package boltcache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultBucket is the bucket entries are stored in when none is given.
+const DefaultBucket = "httpcache"
+
+// Options configures a Cache opened with NewWithOptions.
+type Options struct {
+	// Bucket is the bucket entries are stored in, so that several caches can
+	// share a database file. Defaults to DefaultBucket.
+	Bucket string
+	// ReadOnly opens the database read-only, for example to serve a
+	// snapshot. Set and Delete do nothing on a read-only cache.
+	ReadOnly bool
+	// Timeout is how long to wait for the file lock held by another process.
+	// Zero waits indefinitely.
+	Timeout time.Duration
+}
+
+// Cache is an implementation of httpcache.Cache with bbolt storage
+type Cache struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// Has returns whether key has been cached
+func (c *Cache) Has(key string) (ok bool) {
+	c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(c.bucket); b != nil {
+			ok = b.Get([]byte(key)) != nil
+		}
+		return nil
+	})
+	return
+}
+
+// Get returns the response corresponding to key if present
+func (c *Cache) Get(key string) (resp io.ReadCloser, ok bool) {
+	var data []byte
+	c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(c.bucket); b != nil {
+			// Values are only valid during the transaction, so copy it out.
+			if v := b.Get([]byte(key)); v != nil {
+				data = append([]byte{}, v...)
+			}
+		}
+		return nil
+	})
+	if data == nil {
+		return nil, false
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), true
+}
+
+// Set saves a response to the cache as key
+func (c *Cache) Set(key string, resp io.ReadCloser) {
+	if c.db.IsReadOnly() {
+		return
+	}
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		return
+	}
+	c.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(c.bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// Delete removes the response with key from the cache
+func (c *Cache) Delete(key string) {
+	if c.db.IsReadOnly() {
+		return
+	}
+	c.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(c.bucket); b != nil {
+			return b.Delete([]byte(key))
+		}
+		return nil
+	})
+}
+
+// Keys returns the keys of all entries that start with prefix
+func (c *Cache) Keys(prefix string) (keys []string) {
+	c.scan(prefix, func(k, v []byte) {
+		keys = append(keys, string(k))
+	})
+	return keys
+}
+
+// PurgePrefix removes all entries whose key starts with prefix and returns
+// how many were removed
+func (c *Cache) PurgePrefix(prefix string) (n int) {
+	if c.db.IsReadOnly() {
+		return 0
+	}
+	c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		if b == nil {
+			return nil
+		}
+		// Deleting while iterating with a cursor skips keys, so collect
+		// them first.
+		var keys [][]byte
+		cur := b.Cursor()
+		for k, _ := cur.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = cur.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if b.Delete(k) == nil {
+				n++
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+// Len returns the number of entries
+func (c *Cache) Len() (n int) {
+	c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(c.bucket); b != nil {
+			n = b.Stats().KeyN
+		}
+		return nil
+	})
+	return n
+}
+
+// Size returns the total size of the keys and entries in bytes
+func (c *Cache) Size() (size int64) {
+	c.scan("", func(k, v []byte) {
+		size += int64(len(k) + len(v))
+	})
+	return size
+}
+
+// scan calls fn for every entry whose key starts with prefix. k and v are
+// only valid during the call.
+func (c *Cache) scan(prefix string, fn func(k, v []byte)) {
+	c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		if b == nil {
+			return nil
+		}
+		cur := b.Cursor()
+		for k, v := cur.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = cur.Next() {
+			fn(k, v)
+		}
+		return nil
+	})
+}
+
+// Namespace returns a Cache that shares the database of c but stores its
+// entries in bucket.
+func (c *Cache) Namespace(bucket string) *Cache {
+	return NewWithDB(c.db, bucket)
+}
+
+// Snapshot writes a consistent copy of the whole database file to w, which
+// can later be opened with ReadOnly set. Writes to the cache may continue
+// while the snapshot is taken.
+func (c *Cache) Snapshot(w io.Writer) (n int64, err error) {
+	err = c.db.View(func(tx *bolt.Tx) (err error) {
+		n, err = tx.WriteTo(w)
+		return
+	})
+	return
+}
+
+// Close closes the underlying database.
+func (c *Cache) Close() error {
+	return c.db.Close()
+}
+
+// New returns a new Cache that will store bbolt in path
+func New(path string) (*Cache, error) {
+	return NewWithOptions(path, Options{})
+}
+
+// NewWithOptions returns a new Cache stored in the bbolt file at path,
+// configured by opts.
+func NewWithOptions(path string, opts Options) (*Cache, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		ReadOnly: opts.ReadOnly,
+		Timeout:  opts.Timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewWithDB(db, opts.Bucket), nil
+}
+
+// NewWithDB returns a new Cache using the provided bbolt as underlying
+// storage, with entries stored in bucket. An empty bucket means
+// DefaultBucket.
+func NewWithDB(db *bolt.DB, bucket string) *Cache {
+	if bucket == "" {
+		bucket = DefaultBucket
+	}
+	return &Cache{db: db, bucket: []byte(bucket)}
+}
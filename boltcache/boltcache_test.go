@@ -0,0 +1,70 @@
+package boltcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mchtech/httpcache/test"
+)
+
+func TestBoltCache(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache, err := New(filepath.Join(tempDir, "cache.db"))
+	if err != nil {
+		t.Fatalf("New bbolt: %v", err)
+	}
+	defer cache.Close()
+
+	test.Cache(t, cache)
+	test.Cache(t, cache.Namespace("other"))
+	test.Manage(t, cache)
+}
+
+func TestBoltCacheSnapshot(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache, err := New(filepath.Join(tempDir, "cache.db"))
+	if err != nil {
+		t.Fatalf("New bbolt: %v", err)
+	}
+	defer cache.Close()
+	cache.Set("key", ioutil.NopCloser(strings.NewReader("some bytes")))
+	if cache.Namespace("other").Has("key") {
+		t.Fatal("key visible in another namespace")
+	}
+
+	f, err := os.Create(filepath.Join(tempDir, "snapshot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Snapshot(f); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	f.Close()
+
+	snapshot, err := NewWithOptions(f.Name(), Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("open snapshot: %v", err)
+	}
+	defer snapshot.Close()
+	snapshot.Delete("key")
+	resp, ok := snapshot.Get("key")
+	if !ok {
+		t.Fatal("snapshot is missing key")
+	}
+	if data, _ := ioutil.ReadAll(resp); string(data) != "some bytes" {
+		t.Fatalf("snapshot has %q for key", data)
+	}
+}
@@ -0,0 +1,251 @@
+// Package compresscache provides an implementation of httpcache.Cache that
+// compresses the entries it stores in another Cache.
+//
+// Every stored entry starts with a header byte naming the Codec it was
+// compressed with, or 0 if it was stored as is, so that compressed and
+// uncompressed entries coexist and the codec can be changed without flushing
+// the cache. Entries whose first byte isn't a known codec ID, such as those
+// stored before the wrapper was introduced, are returned unchanged.
+package compresscache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/mchtech/httpcache"
+)
+
+// Codec ID of entries stored without compression.
+const uncompressed = 0
+
+// A Codec compresses and decompresses entries.
+type Codec interface {
+	// ID identifies the codec in the header byte of the entries it
+	// compressed. It must not be 0, nor 'H' or 0x89, the first bytes of
+	// entries written by httpcache.Transport, so that entries stored without
+	// the wrapper are still recognised.
+	ID() byte
+	// NewWriter returns a writer compressing to w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader decompressing r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Gzip is a Codec using compress/gzip at Level, or at the default level if
+// Level is zero. Its ID is 1.
+type Gzip struct {
+	Level int
+}
+
+// ID returns 1
+func (Gzip) ID() byte { return 1 }
+
+// NewWriter returns a gzip writer compressing to w.
+func (c Gzip) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// NewReader returns a gzip reader decompressing r.
+func (Gzip) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// Flate is a Codec using compress/flate at Level, or at the default level if
+// Level is zero. Its ID is 2.
+type Flate struct {
+	Level int
+}
+
+// ID returns 2
+func (Flate) ID() byte { return 2 }
+
+// NewWriter returns a flate writer compressing to w.
+func (c Flate) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	return flate.NewWriter(w, level)
+}
+
+// NewReader returns a flate reader decompressing r.
+func (Flate) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+// Options configures a Cache.
+type Options struct {
+	// Codec compresses new entries. Defaults to Gzip at the default
+	// compression level.
+	Codec Codec
+	// Threshold is the size in bytes below which entries are stored
+	// uncompressed. Defaults to 1024.
+	Threshold int
+	// Codecs are further codecs that entries stored earlier may have been
+	// compressed with. Gzip and Flate are always recognised.
+	Codecs []Codec
+}
+
+// Cache is an implementation of httpcache.Cache that compresses the entries
+// it stores in an underlying Cache.
+type Cache struct {
+	cache     httpcache.Cache
+	codec     Codec
+	threshold int
+	codecs    map[byte]Codec
+}
+
+// Has returns whether key has been cached
+func (c *Cache) Has(key string) (ok bool) {
+	return c.cache.Has(key)
+}
+
+// Get returns the response corresponding to key if present, decompressing it
+// as it is read.
+func (c *Cache) Get(key string) (resp io.ReadCloser, ok bool) {
+	stored, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	br := bufio.NewReader(stored)
+	id, err := br.Peek(1)
+	if err != nil {
+		stored.Close()
+		return nil, false
+	}
+	if id[0] == uncompressed {
+		br.Discard(1)
+		return readCloser{br, stored}, true
+	}
+	codec, ok := c.codecs[id[0]]
+	if !ok {
+		// Not written by this wrapper; return the entry as it is.
+		return readCloser{br, stored}, true
+	}
+	br.Discard(1)
+	zr, err := codec.NewReader(br)
+	if err != nil {
+		stored.Close()
+		return nil, false
+	}
+	return readCloser{zr, multiCloser{zr, stored}}, true
+}
+
+// Set saves a response to the cache as key, compressing it if it is at
+// least Threshold bytes long and compression makes it smaller.
+func (c *Cache) Set(key string, resp io.ReadCloser) {
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		return
+	}
+	if len(data) >= c.threshold {
+		if compressed, err := c.compress(data); err == nil && len(compressed) < len(data)+1 {
+			c.cache.Set(key, ioutil.NopCloser(bytes.NewReader(compressed)))
+			return
+		}
+	}
+	c.cache.Set(key, ioutil.NopCloser(io.MultiReader(bytes.NewReader([]byte{uncompressed}), bytes.NewReader(data))))
+}
+
+// Delete removes the response with key from the cache
+func (c *Cache) Delete(key string) {
+	c.cache.Delete(key)
+}
+
+// Keys returns the keys of all entries that start with prefix, if the
+// underlying Cache is an httpcache.Lister.
+func (c *Cache) Keys(prefix string) (keys []string) {
+	if l, ok := c.cache.(httpcache.Lister); ok {
+		return l.Keys(prefix)
+	}
+	return nil
+}
+
+// PurgePrefix removes all entries whose key starts with prefix, if the
+// underlying Cache is an httpcache.Purger, and returns how many were removed.
+func (c *Cache) PurgePrefix(prefix string) (n int) {
+	if p, ok := c.cache.(httpcache.Purger); ok {
+		return p.PurgePrefix(prefix)
+	}
+	return 0
+}
+
+// Len returns the number of entries, if the underlying Cache is an
+// httpcache.Sizer.
+func (c *Cache) Len() (n int) {
+	if s, ok := c.cache.(httpcache.Sizer); ok {
+		return s.Len()
+	}
+	return 0
+}
+
+// Size returns the total size of the keys and compressed entries in bytes,
+// if the underlying Cache is an httpcache.Sizer.
+func (c *Cache) Size() (size int64) {
+	if s, ok := c.cache.(httpcache.Sizer); ok {
+		return s.Size()
+	}
+	return 0
+}
+
+// compress returns data compressed with c.codec, prefixed with its ID.
+func (c *Cache) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(c.codec.ID())
+	zw, err := c.codec.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() (err error) {
+	for _, c := range m {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return
+}
+
+// New returns a Cache that stores entries in cache, compressed as
+// configured by opts.
+func New(cache httpcache.Cache, opts Options) *Cache {
+	c := &Cache{
+		cache:     cache,
+		codec:     opts.Codec,
+		threshold: opts.Threshold,
+		codecs:    map[byte]Codec{},
+	}
+	if c.codec == nil {
+		c.codec = Gzip{}
+	}
+	if c.threshold <= 0 {
+		c.threshold = 1024
+	}
+	for _, codec := range append([]Codec{Gzip{}, Flate{}, c.codec}, opts.Codecs...) {
+		c.codecs[codec.ID()] = codec
+	}
+	return c
+}
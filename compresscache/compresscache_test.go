@@ -0,0 +1,61 @@
+package compresscache
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/mchtech/httpcache"
+	"github.com/mchtech/httpcache/test"
+)
+
+func TestCompressCache(t *testing.T) {
+	test.Cache(t, New(httpcache.NewMemoryCache(), Options{}))
+	test.Cache(t, New(httpcache.NewMemoryCache(), Options{Codec: Flate{Level: flate.BestSpeed}, Threshold: 1}))
+}
+
+func TestCompressCacheFormats(t *testing.T) {
+	store := httpcache.NewMemoryCache()
+	cache := New(store, Options{Codec: Flate{}, Threshold: 100})
+	large := strings.Repeat(`{"key": "value"}`, 100)
+
+	cache.Set("small", ioutil.NopCloser(strings.NewReader("small")))
+	cache.Set("large", ioutil.NopCloser(strings.NewReader(large)))
+	store.Set("legacy", ioutil.NopCloser(strings.NewReader("HTTP/1.1 200 OK\r\n\r\n")))
+
+	raw, _ := store.Get("large")
+	if data, _ := ioutil.ReadAll(raw); data[0] != (Flate{}).ID() || len(data) >= len(large) {
+		t.Fatalf("large entry not compressed: %d bytes, header %d", len(data), data[0])
+	}
+	gzipped := New(store, Options{Codec: Gzip{}})
+	gzipped.Set("gzip", ioutil.NopCloser(strings.NewReader(large)))
+	raw, _ = store.Get("gzip")
+	if data, _ := ioutil.ReadAll(raw); data[0] != (Gzip{}).ID() || len(data) >= len(large) {
+		t.Fatalf("entry not compressed with Gzip{}: %d bytes, header %d", len(data), data[0])
+	}
+	raw, _ = store.Get("small")
+	if data, _ := ioutil.ReadAll(raw); !bytes.Equal(data, []byte("\x00small")) {
+		t.Fatalf("small entry stored as %q", data)
+	}
+
+	for key, want := range map[string]string{
+		"small":  "small",
+		"large":  large,
+		"legacy": "HTTP/1.1 200 OK\r\n\r\n",
+	} {
+		resp, ok := cache.Get(key)
+		if !ok {
+			t.Fatalf("%s: entry missing", key)
+		}
+		data, err := ioutil.ReadAll(resp)
+		resp.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if string(data) != want {
+			t.Fatalf("%s: got %q", key, data)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Package dedupcache provides an implementation of httpcache.Cache that
+// stores each distinct response body only once in another Cache.
+//
+// The status line and headers of a response are stored under its own key,
+// together with the SHA-256 of its body. Bodies are stored under
+// "dedup-body:<sha256>" and reference counted under "dedup-refs:<sha256>", so
+// a body is only removed when no key refers to it any more. Reference counts
+// are kept consistent by a single Cache; several processes must not share a
+// store through separate Caches.
+package dedupcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mchtech/httpcache"
+)
+
+// magic starts every head entry, followed by the body hash and a newline.
+const magic = "dedup1:"
+
+const (
+	bodyPrefix = "dedup-body:"
+	refsPrefix = "dedup-refs:"
+)
+
+// Cache is an implementation of httpcache.Cache that deduplicates response
+// bodies stored in an underlying Cache.
+type Cache struct {
+	mu    sync.Mutex
+	cache httpcache.Cache
+}
+
+// Has returns whether key has been cached
+func (c *Cache) Has(key string) (ok bool) {
+	return c.cache.Has(key)
+}
+
+// Get returns the response corresponding to key if present
+func (c *Cache) Get(key string) (resp io.ReadCloser, ok bool) {
+	head, sum, ok := c.head(key)
+	if !ok {
+		return nil, false
+	}
+	if sum == "" {
+		// Stored without deduplication.
+		return ioutil.NopCloser(bytes.NewReader(head)), true
+	}
+	body, ok := c.cache.Get(bodyPrefix + sum)
+	if !ok {
+		return nil, false
+	}
+	return readCloser{io.MultiReader(bytes.NewReader(head), body), body}, true
+}
+
+// Set saves a response to the cache as key, storing its body only if no
+// other key refers to the same body.
+func (c *Cache) Set(key string, resp io.ReadCloser) {
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		return
+	}
+	head, body, ok := httpcache.SplitEntry(data)
+	if !ok {
+		// Not a response; store it as it is.
+		c.mu.Lock()
+		c.release(key)
+		c.cache.Set(key, ioutil.NopCloser(bytes.NewReader(data)))
+		c.mu.Unlock()
+		return
+	}
+	h := sha256.Sum256(body)
+	sum := hex.EncodeToString(h[:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, old, ok := c.head(key); !ok || old != sum {
+		c.release(key)
+		if c.refs(sum) == 0 {
+			c.cache.Set(bodyPrefix+sum, ioutil.NopCloser(bytes.NewReader(body)))
+		}
+		c.setRefs(sum, c.refs(sum)+1)
+	}
+	entry := make([]byte, 0, len(magic)+len(sum)+1+len(head))
+	entry = append(entry, magic+sum+"\n"...)
+	entry = append(entry, head...)
+	c.cache.Set(key, ioutil.NopCloser(bytes.NewReader(entry)))
+}
+
+// Delete removes the response with key from the cache, and its body if no
+// other key refers to it
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	c.release(key)
+	c.cache.Delete(key)
+	c.mu.Unlock()
+}
+
+// Keys returns the keys of all entries that start with prefix, if the
+// underlying Cache is an httpcache.Lister.
+func (c *Cache) Keys(prefix string) (keys []string) {
+	l, ok := c.cache.(httpcache.Lister)
+	if !ok {
+		return nil
+	}
+	for _, key := range l.Keys(prefix) {
+		if !strings.HasPrefix(key, bodyPrefix) && !strings.HasPrefix(key, refsPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// PurgePrefix removes all entries whose key starts with prefix, and the
+// bodies no other key refers to, if the underlying Cache is an
+// httpcache.Lister. It returns how many entries were removed.
+func (c *Cache) PurgePrefix(prefix string) (n int) {
+	for _, key := range c.Keys(prefix) {
+		c.Delete(key)
+		n++
+	}
+	return n
+}
+
+// Len returns the number of entries, if the underlying Cache is an
+// httpcache.Lister.
+func (c *Cache) Len() (n int) {
+	return len(c.Keys(""))
+}
+
+// Size returns the total size in bytes of what is stored in the underlying
+// Cache, with each body counted once, if it is an httpcache.Sizer.
+func (c *Cache) Size() (size int64) {
+	if s, ok := c.cache.(httpcache.Sizer); ok {
+		return s.Size()
+	}
+	return 0
+}
+
+// head returns the head entry stored for key and the hash of its body, which
+// is empty for entries stored without deduplication.
+func (c *Cache) head(key string) (head []byte, sum string, ok bool) {
+	r, ok := c.cache.Get(key)
+	if !ok {
+		return nil, "", false
+	}
+	entry, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, "", false
+	}
+	if !bytes.HasPrefix(entry, []byte(magic)) {
+		return entry, "", true
+	}
+	i := bytes.IndexByte(entry, '\n')
+	if i < 0 {
+		return nil, "", false
+	}
+	return entry[i+1:], string(entry[len(magic):i]), true
+}
+
+// release drops the reference of key to its body, removing the body if it
+// was the last one. c.mu must be held.
+func (c *Cache) release(key string) {
+	_, sum, ok := c.head(key)
+	if !ok || sum == "" {
+		return
+	}
+	refs := c.refs(sum) - 1
+	if refs > 0 {
+		c.setRefs(sum, refs)
+		return
+	}
+	c.cache.Delete(bodyPrefix + sum)
+	c.cache.Delete(refsPrefix + sum)
+}
+
+func (c *Cache) refs(sum string) (n int) {
+	r, ok := c.cache.Get(refsPrefix + sum)
+	if !ok {
+		return 0
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	n, _ = strconv.Atoi(string(data))
+	return
+}
+
+func (c *Cache) setRefs(sum string, n int) {
+	c.cache.Set(refsPrefix+sum, ioutil.NopCloser(bytes.NewReader([]byte(strconv.Itoa(n)))))
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// New returns a Cache that stores deduplicated entries in cache.
+func New(cache httpcache.Cache) *Cache {
+	return &Cache{cache: cache}
+}
@@ -0,0 +1,60 @@
+package dedupcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/mchtech/httpcache"
+	"github.com/mchtech/httpcache/test"
+)
+
+func TestDedupCache(t *testing.T) {
+	test.Cache(t, New(httpcache.NewMemoryCache()))
+	test.Manage(t, New(httpcache.NewMemoryCache()))
+}
+
+func TestDedupCacheSharedBodies(t *testing.T) {
+	store := httpcache.NewMemoryCache()
+	cache := New(store)
+	entry := func(etag, body string) string {
+		return "HTTP/1.1 200 OK\r\nEtag: " + etag + "\r\n\r\n" + body
+	}
+	set := func(key, value string) {
+		cache.Set(key, ioutil.NopCloser(strings.NewReader(value)))
+	}
+	stored := func(body string) bool {
+		sum := sha256.Sum256([]byte(body))
+		return store.Has(bodyPrefix + hex.EncodeToString(sum[:]))
+	}
+	set("http://example.com/a.js?v=1", entry("1", "shared body"))
+	set("http://example.com/a.js?v=2", entry("2", "shared body"))
+	set("http://example.com/b.js", entry("3", "other body"))
+
+	if !stored("shared body") || !stored("other body") {
+		t.Fatal("bodies not stored")
+	}
+	resp, ok := cache.Get("http://example.com/a.js?v=2")
+	if !ok {
+		t.Fatal("entry missing")
+	}
+	if data, _ := ioutil.ReadAll(resp); string(data) != entry("2", "shared body") {
+		t.Fatalf("got %q", data)
+	}
+
+	cache.Delete("http://example.com/a.js?v=1")
+	if !stored("shared body") {
+		t.Fatal("body removed while still referenced")
+	}
+	// Overwriting the last reference with a different body releases it.
+	set("http://example.com/a.js?v=2", entry("2", "changed body"))
+	cache.Delete("http://example.com/b.js")
+	if stored("shared body") || stored("other body") {
+		t.Fatal("unreferenced body kept")
+	}
+	if !stored("changed body") {
+		t.Fatal("referenced body removed")
+	}
+}
@@ -1,19 +1,94 @@
 // Package diskcache provides an implementation of httpcache.Cache that uses the diskv package
 // to supplement an in-memory map with persistent storage
 //
+// Entries are written to a temporary file which is synced and then renamed
+// into place, and end with a footer recording their length, so that an entry
+// left incomplete by a crash is detected and discarded when it is read.
+// Entries written by earlier versions of this package have no footer; they
+// are still served as long as they parse as a complete response, and are
+// replaced by footered entries as responses are stored again. The footer also
+// records the entry's key, which the hashed file name doesn't reveal, so that
+// the cache can be enumerated.
 package diskcache
 
 import (
+	"bytes"
 	"crypto/md5"
+	"encoding/binary"
 	"encoding/hex"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mchtech/diskv/v3"
+	"github.com/mchtech/httpcache"
 )
 
+// tempDirName is the directory within the base path that entries are
+// written to before being moved into place.
+const tempDirName = ".tmp"
+
+// footerMagic ends every entry. An entry's footer is its key, the length of
+// the key (4 bytes) and the length of its content (8 bytes), followed by
+// footerMagic.
+var footerMagic = []byte("\x00hcdisk1")
+
+const footerTrailer = 4 + 8 + 8
+
+// Options configures a Cache created with NewWithOptions.
+type Options struct {
+	// BasePath is the directory the cache files are stored in.
+	BasePath string
+	// ShardDepth is the number of directory levels the cache files are spread
+	// over, each level named after the next two hex digits of the file name.
+	// Zero stores all files directly in BasePath.
+	ShardDepth int
+	// MemorySize is the budget in bytes of diskv's in-memory copy of
+	// recently read entries. Zero disables it.
+	MemorySize uint64
+	// MaxSize is the maximum total size in bytes of the cache files. When it
+	// is exceeded the least recently used entries are evicted until the
+	// cache is back under 90% of MaxSize, so that the sweeper doesn't run
+	// after every write. Zero means unlimited.
+	MaxSize int64
+	// StaleTTL is how long entries are kept after they stop being fresh, so
+	// that they can still be revalidated with the origin. Zero keeps them
+	// until they are evicted for space.
+	StaleTTL time.Duration
+	// SweepInterval is how often expired entries are removed and MaxSize is
+	// enforced in the background. Zero disables the periodic sweep; Sweep can
+	// still be called directly, and with MaxSize set the cache is still swept
+	// when it is opened and whenever it grows past MaxSize.
+	SweepInterval time.Duration
+}
+
+// DefaultOptions returns the Options used by New for a cache in basePath.
+func DefaultOptions(basePath string) Options {
+	return Options{
+		BasePath:   basePath,
+		MemorySize: 100 * 1024 * 1024, // 100MB
+	}
+}
+
 // Cache is an implementation of httpcache.Cache that supplements the in-memory map with persistent storage
 type Cache struct {
-	d *diskv.Diskv
+	d    *diskv.Diskv
+	opts Options
+
+	// size is the total size of the cache files, as of the last sweep
+	// adjusted by what has been written and removed since.
+	size int64
+
+	wake      chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
 }
 
 // Has returns whether key has been cached
@@ -21,25 +96,250 @@ func (c *Cache) Has(key string) (ok bool) {
 	return c.d.Has(keyToFilename(key))
 }
 
-// Get returns the response corresponding to key if present
+// Get returns the response corresponding to key if present. Incomplete
+// entries are removed and reported as missing.
 func (c *Cache) Get(key string) (resp io.ReadCloser, ok bool) {
 	key = keyToFilename(key)
-	if stream, err := c.d.ReadStream(key, true); err == nil {
-		return stream, true
+	stream, err := c.d.ReadStream(key, false)
+	if err != nil {
+		return nil, false
+	}
+	data, err := ioutil.ReadAll(stream)
+	stream.Close()
+	if err != nil {
+		return nil, false
+	}
+	content, _, ok := splitFooter(data)
+	if !ok {
+		if !isLegacyEntry(data) {
+			c.erase(key)
+			return nil, false
+		}
+		content = data
 	}
-	return nil, false
+	if c.opts.MaxSize > 0 {
+		// Record the access in the modification time, which unlike the
+		// access time is kept on noatime mounts.
+		now := time.Now()
+		os.Chtimes(c.filename(key), now, now)
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), true
 }
 
 // Set saves a response to the cache as key
 func (c *Cache) Set(key string, resp io.ReadCloser) {
-	key = keyToFilename(key)
-	c.d.WriteStream(key, resp, true)
+	er := &entryReader{r: resp, key: key}
+	filename := keyToFilename(key)
+	old := c.fileSize(filename)
+	if c.d.WriteStream(filename, er, true) != nil {
+		return
+	}
+	size := atomic.AddInt64(&c.size, er.n+int64(len(key)+footerTrailer)-old)
+	if c.opts.MaxSize > 0 && size > c.opts.MaxSize {
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
 }
 
 // Delete removes the response with key from the cache
 func (c *Cache) Delete(key string) {
-	key = keyToFilename(key)
-	c.d.Erase(key)
+	c.erase(keyToFilename(key))
+}
+
+// erase removes the file diskv stores key in and subtracts its size from
+// c.size.
+func (c *Cache) erase(key string) {
+	size := c.fileSize(key)
+	if c.d.Erase(key) == nil {
+		atomic.AddInt64(&c.size, -size)
+	}
+}
+
+// fileSize returns the size of the file diskv stores key in, or 0 if there
+// is none.
+func (c *Cache) fileSize(key string) int64 {
+	info, err := os.Stat(c.filename(key))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Sweep removes the entries that have been stale for longer than StaleTTL
+// and then, if the cache is larger than MaxSize, the least recently used
+// entries until it is under 90% of MaxSize.
+func (c *Cache) Sweep() {
+	type cacheFile struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var files []cacheFile
+	var total int64
+	now := time.Now()
+	c.walk(func(path string, info os.FileInfo) {
+		key := c.filenameToKey(path)
+		if c.expired(path, info, now) {
+			c.d.Erase(key)
+			return
+		}
+		files = append(files, cacheFile{key, info.Size(), info.ModTime()})
+		total += info.Size()
+	})
+
+	if c.opts.MaxSize > 0 && total > c.opts.MaxSize {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].modTime.Before(files[j].modTime)
+		})
+		target := c.opts.MaxSize - c.opts.MaxSize/10
+		for _, f := range files {
+			if total <= target {
+				break
+			}
+			if c.d.Erase(f.key) == nil {
+				total -= f.size
+			}
+		}
+	}
+	atomic.StoreInt64(&c.size, total)
+}
+
+// Keys returns the keys of all entries that start with prefix. Entries
+// written by earlier versions of this package don't record their key and
+// are left out, as they are by PurgePrefix.
+func (c *Cache) Keys(prefix string) (keys []string) {
+	c.walk(func(path string, info os.FileInfo) {
+		if key, _, ok := readFooter(path, info); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	})
+	return keys
+}
+
+// PurgePrefix removes all entries whose key starts with prefix and returns
+// how many were removed.
+func (c *Cache) PurgePrefix(prefix string) (n int) {
+	c.walk(func(path string, info os.FileInfo) {
+		key, _, ok := readFooter(path, info)
+		if !ok || !strings.HasPrefix(key, prefix) {
+			return
+		}
+		if c.d.Erase(c.filenameToKey(path)) == nil {
+			atomic.AddInt64(&c.size, -info.Size())
+			n++
+		}
+	})
+	return n
+}
+
+// Len returns the number of entries, including those written by earlier
+// versions of this package that Keys can't list, so that callers can tell
+// whether Keys listed every entry.
+func (c *Cache) Len() (n int) {
+	c.walk(func(path string, info os.FileInfo) {
+		n++
+	})
+	return n
+}
+
+// Size returns the total size of the keys and entries in bytes, not
+// counting the footers. Entries written by earlier versions of this package
+// count with their file size.
+func (c *Cache) Size() (size int64) {
+	c.walk(func(path string, info os.FileInfo) {
+		if key, length, ok := readFooter(path, info); ok {
+			size += int64(len(key)) + length
+		} else {
+			size += info.Size()
+		}
+	})
+	return size
+}
+
+// walk calls fn for every cache file.
+func (c *Cache) walk(fn func(path string, info os.FileInfo)) {
+	filepath.Walk(c.d.BasePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path == c.d.TempDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fn(path, info)
+		return nil
+	})
+}
+
+// Close stops the background sweeper.
+func (c *Cache) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.wg.Wait()
+	})
+	return nil
+}
+
+// expired reports whether the cache file at path has been stale for longer
+// than StaleTTL. Files that can't be parsed as a response, or that have no
+// Date, are considered stale from their modification time.
+func (c *Cache) expired(path string, info os.FileInfo, now time.Time) bool {
+	if c.opts.StaleTTL <= 0 {
+		return false
+	}
+	expires := info.ModTime()
+	if f, err := os.Open(path); err == nil {
+		if resp, err := httpcache.ReadEntryHeader(f); err == nil {
+			if t, ok := httpcache.ExpiresAt(resp.Header); ok {
+				expires = t
+			}
+		}
+		f.Close()
+	}
+	return now.After(expires.Add(c.opts.StaleTTL))
+}
+
+// sweeper sweeps the cache when it is opened, which also measures the
+// entries already stored, and then every SweepInterval, if set, and whenever
+// Set finds it larger than MaxSize.
+func (c *Cache) sweeper() {
+	defer c.wg.Done()
+	var tick <-chan time.Time
+	if c.opts.SweepInterval > 0 {
+		ticker := time.NewTicker(c.opts.SweepInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		c.Sweep()
+		select {
+		case <-c.done:
+			return
+		case <-tick:
+		case <-c.wake:
+		}
+	}
+}
+
+// filename returns the path of the file diskv stores key in.
+func (c *Cache) filename(key string) string {
+	pathKey := c.d.AdvancedTransform(key)
+	return filepath.Join(c.d.BasePath, filepath.Join(pathKey.Path...), pathKey.FileName)
+}
+
+// filenameToKey returns the diskv key stored in the file at path.
+func (c *Cache) filenameToKey(path string) string {
+	rel, _ := filepath.Rel(c.d.BasePath, path)
+	dir, file := filepath.Split(rel)
+	pathKey := &diskv.PathKey{FileName: file}
+	if dir = strings.TrimSuffix(dir, string(filepath.Separator)); dir != "" {
+		pathKey.Path = strings.Split(dir, string(filepath.Separator))
+	}
+	return c.d.InverseTransform(pathKey)
 }
 
 func keyToFilename(key string) string {
@@ -48,18 +348,164 @@ func keyToFilename(key string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// shardTransform returns a diskv.TransformFunction that spreads files over
+// depth levels of directories named after pairs of hex digits of the file
+// name, or nil for a flat layout.
+func shardTransform(depth int) diskv.TransformFunction {
+	if depth <= 0 {
+		return nil
+	}
+	if depth > md5.Size {
+		depth = md5.Size
+	}
+	return func(s string) []string {
+		path := make([]string, 0, depth)
+		for i := 0; i < depth && 2*i+2 <= len(s); i++ {
+			path = append(path, s[2*i:2*i+2])
+		}
+		return path
+	}
+}
+
+// entryReader reads the content of an entry from r and then its footer.
+type entryReader struct {
+	r      io.Reader
+	key    string
+	n      int64
+	footer []byte
+}
+
+func (r *entryReader) Read(p []byte) (n int, err error) {
+	if r.footer == nil {
+		n, err = r.r.Read(p)
+		r.n += int64(n)
+		if err != io.EOF {
+			return
+		}
+		r.footer = appendFooter(nil, r.key, r.n)
+		if n > 0 {
+			return n, nil
+		}
+	}
+	n = copy(p, r.footer)
+	r.footer = r.footer[n:]
+	if len(r.footer) == 0 {
+		err = io.EOF
+	}
+	return
+}
+
+// appendFooter appends the footer of an entry with the given key and
+// content length to b.
+func appendFooter(b []byte, key string, length int64) []byte {
+	b = append(b, key...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(key)))
+	b = binary.BigEndian.AppendUint64(b, uint64(length))
+	return append(b, footerMagic...)
+}
+
+// parseTrailer parses the end of an entry of the given size, returning the
+// lengths of its key and content.
+func parseTrailer(trailer []byte, size int64) (keyLen, length int64, ok bool) {
+	if len(trailer) < footerTrailer || !bytes.HasSuffix(trailer, footerMagic) {
+		return 0, 0, false
+	}
+	trailer = trailer[len(trailer)-footerTrailer:]
+	keyLen = int64(binary.BigEndian.Uint32(trailer))
+	length = int64(binary.BigEndian.Uint64(trailer[4:]))
+	return keyLen, length, length+keyLen+footerTrailer == size
+}
+
+// splitFooter returns the content and key of the entry data, and false if
+// its footer is missing or doesn't match its length.
+func splitFooter(data []byte) (content []byte, key string, ok bool) {
+	keyLen, length, ok := parseTrailer(data, int64(len(data)))
+	if !ok {
+		return nil, "", false
+	}
+	return data[:length], string(data[length : length+keyLen]), true
+}
+
+// isLegacyEntry reports whether data, which has no footer, is a complete
+// entry written by an earlier version of this package.
+func isLegacyEntry(data []byte) bool {
+	resp, err := httpcache.ReadEntry(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return err == nil
+}
+
+// readFooter reads the key and content length from the footer of the cache
+// file at path.
+func readFooter(path string, info os.FileInfo) (key string, length int64, ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, false
+	}
+	defer f.Close()
+	size := info.Size()
+	trailer := make([]byte, footerTrailer)
+	if size < footerTrailer {
+		trailer = trailer[:size]
+	}
+	if _, err := f.ReadAt(trailer, size-int64(len(trailer))); err != nil {
+		return "", 0, false
+	}
+	keyLen, length, ok := parseTrailer(trailer, size)
+	if !ok {
+		return "", 0, false
+	}
+	k := make([]byte, keyLen)
+	if _, err := f.ReadAt(k, length); err != nil {
+		return "", 0, false
+	}
+	return string(k), length, true
+}
+
 // New returns a new Cache that will store files in basePath
 func New(basePath string) *Cache {
-	return &Cache{
-		d: diskv.New(diskv.Options{
-			BasePath:     basePath,
-			CacheSizeMax: 100 * 1024 * 1024, // 100MB
-		}),
+	return NewWithOptions(DefaultOptions(basePath))
+}
+
+// NewWithOptions returns a new Cache configured by opts. Temporary files
+// left behind by an earlier process are removed, so the same BasePath must
+// not be used by several processes at once. If MaxSize or SweepInterval is
+// set, a background sweeper is started, which runs until Close is called.
+func NewWithOptions(opts Options) *Cache {
+	c := newCacheWithOptions(opts)
+	if opts.MaxSize > 0 || opts.SweepInterval > 0 {
+		c.wg.Add(1)
+		go c.sweeper()
 	}
+	return c
+}
+
+// newCacheWithOptions is like NewWithOptions but doesn't start the sweeper.
+func newCacheWithOptions(opts Options) *Cache {
+	tempDir := filepath.Join(opts.BasePath, tempDirName)
+	os.RemoveAll(tempDir)
+	return newCache(diskv.New(diskv.Options{
+		BasePath:     opts.BasePath,
+		TempDir:      tempDir,
+		Transform:    shardTransform(opts.ShardDepth),
+		CacheSizeMax: opts.MemorySize,
+	}), opts)
 }
 
 // NewWithDiskv returns a new Cache using the provided Diskv as underlying
 // storage.
 func NewWithDiskv(d *diskv.Diskv) *Cache {
-	return &Cache{d}
+	return newCache(d, Options{BasePath: d.BasePath})
+}
+
+func newCache(d *diskv.Diskv, opts Options) *Cache {
+	return &Cache{
+		d:    d,
+		opts: opts,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
 }
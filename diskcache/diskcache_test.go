@@ -3,8 +3,14 @@ package diskcache
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/mchtech/httpcache"
 	"github.com/mchtech/httpcache/test"
 )
 
@@ -15,5 +21,192 @@ func TestDiskCache(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	test.Cache(t, New(tempDir))
+	cache := New(tempDir)
+	test.Cache(t, cache)
+	test.Manage(t, cache)
+	test.Tags(t, cache)
+}
+
+func TestDiskCacheSweep(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Sweep is called directly, without the background sweeper.
+	cache := newCacheWithOptions(Options{
+		BasePath:   tempDir,
+		ShardDepth: 2,
+		MaxSize:    300,
+		StaleTTL:   time.Hour,
+	})
+	test.Cache(t, cache)
+
+	now := time.Now().UTC()
+	entry := func(date time.Time) string {
+		return "HTTP/1.1 200 OK\r\n" +
+			"Date: " + date.Format(time.RFC1123) + "\r\n" +
+			"Cache-Control: max-age=60\r\n" +
+			"Content-Length: 0\r\n\r\n"
+	}
+	cache.Set("expired", ioutil.NopCloser(strings.NewReader(entry(now.Add(-2*time.Hour)))))
+	cache.Set("old", ioutil.NopCloser(strings.NewReader(entry(now))))
+	cache.Set("recent", ioutil.NopCloser(strings.NewReader(entry(now))))
+	cache.Set("new", ioutil.NopCloser(strings.NewReader(entry(now))))
+
+	name := keyToFilename("old")
+	filename := filepath.Join(tempDir, name[0:2], name[2:4], name)
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatalf("entry not stored in shard directory: %v", err)
+	}
+	old := now.Add(-time.Minute)
+	if err := os.Chtimes(filename, old, old); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(cache.filename(keyToFilename("recent")), old, old)
+	// Reading an entry marks it as recently used.
+	if _, ok := cache.Get("recent"); !ok {
+		t.Fatal("entry missing")
+	}
+
+	cache.Sweep()
+	if cache.Has("expired") {
+		t.Error("expired entry not removed")
+	}
+	if cache.Has("old") {
+		t.Error("least recently used entry not evicted")
+	}
+	if !cache.Has("recent") || !cache.Has("new") {
+		t.Error("recently used entries evicted")
+	}
+	if cache.size > 270 {
+		t.Errorf("swept down to %d bytes, want at most 90%% of MaxSize", cache.size)
+	}
+
+	// Overwrites and deletions are accounted for without a sweep.
+	size := cache.size
+	cache.Set("new", ioutil.NopCloser(strings.NewReader(entry(now))))
+	if cache.size != size {
+		t.Errorf("size %d after overwriting an entry, want %d", cache.size, size)
+	}
+	cache.Delete("new")
+	cache.Delete("recent")
+	if cache.size != 0 {
+		t.Errorf("size %d after deleting all entries, want 0", cache.size)
+	}
+}
+
+func TestDiskCacheMaxSize(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	value := strings.Repeat("x", 100)
+	unlimited := New(tempDir)
+	for i := 0; i < 10; i++ {
+		unlimited.Set(strconv.Itoa(i), ioutil.NopCloser(strings.NewReader(value)))
+	}
+	unlimited.Close()
+
+	// waitSize waits for the sweeper to bring the cache under 90% of
+	// MaxSize.
+	waitSize := func(cache *Cache) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt64(&cache.size) > 270 || len(cache.Keys("")) > 2 {
+			if time.Now().After(deadline) {
+				t.Fatalf("cache not swept: %d bytes", atomic.LoadInt64(&cache.size))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Entries stored before the cache was opened count towards MaxSize,
+	// which is enforced without a SweepInterval.
+	cache := NewWithOptions(Options{BasePath: tempDir, MaxSize: 300})
+	defer cache.Close()
+	waitSize(cache)
+	for i := 10; i < 20; i++ {
+		cache.Set(strconv.Itoa(i), ioutil.NopCloser(strings.NewReader(value)))
+		waitSize(cache)
+	}
+}
+
+func TestDiskCacheRecovery(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	orphan := filepath.Join(tempDir, tempDirName, "orphan")
+	if err := os.MkdirAll(filepath.Dir(orphan), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(orphan, []byte("partial"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := New(tempDir)
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("orphaned temp file not removed: %v", err)
+	}
+
+	cache.Set("key", ioutil.NopCloser(strings.NewReader("some bytes")))
+	filename := cache.filename(keyToFilename("key"))
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filename, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Use a fresh Cache so the entry isn't served from diskv's memory.
+	cache = New(tempDir)
+	if _, ok := cache.Get("key"); ok {
+		t.Fatal("truncated entry returned")
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("truncated entry not removed: %v", err)
+	}
+
+	// Entries written before footers were added are kept if they are
+	// complete.
+	legacy := "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nbody"
+	for _, tc := range []struct {
+		entry string
+		ok    bool
+	}{{legacy, true}, {legacy[:len(legacy)-1], false}} {
+		if err := ioutil.WriteFile(filename, []byte(tc.entry), 0666); err != nil {
+			t.Fatal(err)
+		}
+		cache = New(tempDir)
+		r, ok := cache.Get("key")
+		if ok != tc.ok {
+			t.Fatalf("got %v for legacy entry %q", ok, tc.entry)
+		}
+		if ok {
+			data, _ := ioutil.ReadAll(r)
+			if string(data) != tc.entry {
+				t.Fatalf("got %q, want %q", data, tc.entry)
+			}
+			// Len counts the entry that Keys can't list, so that a ban
+			// isn't retired without checking it.
+			if n, keys := cache.Len(), cache.Keys(""); n != 1 || len(keys) != 0 {
+				t.Fatalf("Len() = %d, Keys() = %q for a legacy entry", n, keys)
+			}
+			tp := httpcache.NewTransport(cache)
+			if err := tp.Ban("req.url ~ ."); err != nil {
+				t.Fatal(err)
+			}
+			tp.Lurk()
+			if bans := tp.Bans(); len(bans) != 1 {
+				t.Fatalf("ban retired by a pass that missed a legacy entry: %v", bans)
+			}
+		}
+	}
 }
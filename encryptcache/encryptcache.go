@@ -0,0 +1,216 @@
+// Package encryptcache provides an implementation of httpcache.Cache that
+// encrypts the entries it stores in another Cache with AES-GCM, so that
+// cached responses are not readable from the underlying store.
+//
+// Each entry is stored in an envelope recording the ID of the key it was
+// encrypted with:
+//
+//	version (1 byte) | key ID (4 bytes, big-endian) | nonce (12 bytes) | ciphertext and tag
+//
+// New entries are encrypted with the current key while entries encrypted
+// with older keys remain readable for as long as those keys are configured,
+// which allows keys to be rotated without flushing the cache. The cache key is
+// authenticated as additional data, so entries can't be moved between keys.
+//
+// Optionally, cache keys can be replaced by their HMAC-SHA256 so that the
+// URLs of cached responses aren't visible in the store either. Such a cache
+// can't list or purge its entries by prefix.
+package encryptcache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/mchtech/httpcache"
+)
+
+const envelopeVersion = 1
+
+// headerSize is the size of the envelope before the nonce.
+const headerSize = 1 + 4
+
+// Options configures a Cache.
+type Options struct {
+	// Keys are the AES keys entries may be encrypted with, by key ID. Each
+	// must be 16, 24 or 32 bytes long.
+	Keys map[uint32][]byte
+	// CurrentKey is the ID of the key new entries are encrypted with.
+	CurrentKey uint32
+	// HashKey, if set, is used to replace cache keys by their HMAC-SHA256
+	// before they are passed to the underlying Cache.
+	HashKey []byte
+}
+
+// Cache is an implementation of httpcache.Cache that encrypts the entries it
+// stores in an underlying Cache.
+type Cache struct {
+	cache   httpcache.Cache
+	aeads   map[uint32]cipher.AEAD
+	current uint32
+	hashKey []byte
+}
+
+// Has returns whether key has been cached
+func (c *Cache) Has(key string) (ok bool) {
+	return c.cache.Has(c.storeKey(key))
+}
+
+// Get returns the decrypted response corresponding to key if present. Entries
+// that fail to decrypt are reported as missing.
+func (c *Cache) Get(key string) (resp io.ReadCloser, ok bool) {
+	storeKey := c.storeKey(key)
+	r, ok := c.cache.Get(storeKey)
+	if !ok {
+		return nil, false
+	}
+	envelope, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, false
+	}
+	data, err := c.open(storeKey, envelope)
+	if err != nil {
+		return nil, false
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), true
+}
+
+// Set encrypts a response and saves it to the cache as key
+func (c *Cache) Set(key string, resp io.ReadCloser) {
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		return
+	}
+	storeKey := c.storeKey(key)
+	envelope, err := c.seal(storeKey, data)
+	if err != nil {
+		return
+	}
+	c.cache.Set(storeKey, ioutil.NopCloser(bytes.NewReader(envelope)))
+}
+
+// Delete removes the response with key from the cache
+func (c *Cache) Delete(key string) {
+	c.cache.Delete(c.storeKey(key))
+}
+
+// listingCache is a Cache whose keys aren't hashed, so that they can be
+// listed and purged by prefix.
+type listingCache struct {
+	*Cache
+}
+
+// Keys returns the keys of all entries that start with prefix, if the
+// underlying Cache is an httpcache.Lister.
+func (c listingCache) Keys(prefix string) (keys []string) {
+	if l, ok := c.cache.(httpcache.Lister); ok {
+		return l.Keys(prefix)
+	}
+	return nil
+}
+
+// PurgePrefix removes all entries whose key starts with prefix, if the
+// underlying Cache is an httpcache.Purger, and returns how many were
+// removed.
+func (c listingCache) PurgePrefix(prefix string) (n int) {
+	if p, ok := c.cache.(httpcache.Purger); ok {
+		return p.PurgePrefix(prefix)
+	}
+	return 0
+}
+
+// Len returns the number of entries, if the underlying Cache is an
+// httpcache.Sizer.
+func (c *Cache) Len() (n int) {
+	if s, ok := c.cache.(httpcache.Sizer); ok {
+		return s.Len()
+	}
+	return 0
+}
+
+// Size returns the total size of the stored keys and encrypted entries in
+// bytes, if the underlying Cache is an httpcache.Sizer.
+func (c *Cache) Size() (size int64) {
+	if s, ok := c.cache.(httpcache.Sizer); ok {
+		return s.Size()
+	}
+	return 0
+}
+
+// storeKey returns the key used for key in the underlying cache.
+func (c *Cache) storeKey(key string) string {
+	if c.hashKey == nil {
+		return key
+	}
+	mac := hmac.New(sha256.New, c.hashKey)
+	io.WriteString(mac, key)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *Cache) seal(storeKey string, data []byte) ([]byte, error) {
+	aead := c.aeads[c.current]
+	envelope := make([]byte, headerSize+aead.NonceSize(), headerSize+aead.NonceSize()+len(data)+aead.Overhead())
+	envelope[0] = envelopeVersion
+	binary.BigEndian.PutUint32(envelope[1:], c.current)
+	nonce := envelope[headerSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(envelope, nonce, data, []byte(storeKey)), nil
+}
+
+var errInvalidEnvelope = errors.New("encryptcache: invalid envelope")
+
+func (c *Cache) open(storeKey string, envelope []byte) ([]byte, error) {
+	if len(envelope) < headerSize || envelope[0] != envelopeVersion {
+		return nil, errInvalidEnvelope
+	}
+	id := binary.BigEndian.Uint32(envelope[1:])
+	aead, ok := c.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("encryptcache: unknown key ID %d", id)
+	}
+	if len(envelope) < headerSize+aead.NonceSize() {
+		return nil, errInvalidEnvelope
+	}
+	nonce, ciphertext := envelope[headerSize:headerSize+aead.NonceSize()], envelope[headerSize+aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(storeKey))
+}
+
+// New returns a Cache that stores entries in cache, encrypted with the keys
+// in opts. Unless opts.HashKey is set, it is also an httpcache.Lister and an
+// httpcache.Purger.
+func New(cache httpcache.Cache, opts Options) (httpcache.Cache, error) {
+	if _, ok := opts.Keys[opts.CurrentKey]; !ok {
+		return nil, fmt.Errorf("encryptcache: current key ID %d not in Keys", opts.CurrentKey)
+	}
+	c := &Cache{
+		cache:   cache,
+		aeads:   make(map[uint32]cipher.AEAD, len(opts.Keys)),
+		current: opts.CurrentKey,
+		hashKey: opts.HashKey,
+	}
+	for id, key := range opts.Keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryptcache: key ID %d: %v", id, err)
+		}
+		if c.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if c.hashKey != nil {
+		return c, nil
+	}
+	return listingCache{c}, nil
+}
@@ -0,0 +1,93 @@
+package encryptcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/mchtech/httpcache"
+	"github.com/mchtech/httpcache/test"
+)
+
+var (
+	key1 = bytes.Repeat([]byte{1}, 32)
+	key2 = bytes.Repeat([]byte{2}, 16)
+)
+
+func TestEncryptCache(t *testing.T) {
+	cache, err := New(httpcache.NewMemoryCache(), Options{
+		Keys:       map[uint32][]byte{1: key1},
+		CurrentKey: 1,
+		HashKey:    []byte("secret"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Cache(t, cache)
+
+	cache, err = New(httpcache.NewMemoryCache(), Options{Keys: map[uint32][]byte{1: key1}, CurrentKey: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Cache(t, cache)
+	cache.Set("http://example.com/a", ioutil.NopCloser(strings.NewReader("value")))
+	if keys := cache.(httpcache.Lister).Keys("http://example.com/"); len(keys) != 1 {
+		t.Fatalf("Keys() = %q, want one key", keys)
+	}
+	if n := cache.(httpcache.Purger).PurgePrefix("http://example.com/"); n != 1 {
+		t.Fatalf("PurgePrefix() = %d, want 1", n)
+	}
+}
+
+func TestEncryptCacheRotation(t *testing.T) {
+	store := httpcache.NewMemoryCache()
+	old, err := New(store, Options{Keys: map[uint32][]byte{1: key1}, CurrentKey: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Set("http://example.com/", ioutil.NopCloser(strings.NewReader("secret response")))
+
+	raw, _ := store.Get("http://example.com/")
+	if data, _ := ioutil.ReadAll(raw); bytes.Contains(data, []byte("secret response")) {
+		t.Fatal("entry stored in plain text")
+	}
+
+	rotated, err := New(store, Options{Keys: map[uint32][]byte{1: key1, 2: key2}, CurrentKey: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, ok := rotated.Get("http://example.com/")
+	if !ok {
+		t.Fatal("entry encrypted with previous key not readable")
+	}
+	if data, _ := ioutil.ReadAll(resp); string(data) != "secret response" {
+		t.Fatalf("got %q", data)
+	}
+
+	rotated.Set("http://example.com/new", ioutil.NopCloser(strings.NewReader("new")))
+	if _, ok := old.Get("http://example.com/new"); ok {
+		t.Fatal("entry encrypted with unknown key was returned")
+	}
+}
+
+func TestEncryptCacheHashedKeys(t *testing.T) {
+	store := httpcache.NewMemoryCache()
+	cache, err := New(store, Options{Keys: map[uint32][]byte{1: key1}, CurrentKey: 1, HashKey: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("http://example.com/private", ioutil.NopCloser(strings.NewReader("value")))
+	if store.Has("http://example.com/private") {
+		t.Fatal("URL visible in the underlying cache")
+	}
+	if !store.Has(cache.(*Cache).storeKey("http://example.com/private")) {
+		t.Fatal("entry not stored under its hashed key")
+	}
+	if _, ok := cache.(httpcache.Lister); ok {
+		t.Fatal("cache with hashed keys is a Lister")
+	}
+	if _, ok := cache.(httpcache.Purger); ok {
+		t.Fatal("cache with hashed keys is a Purger")
+	}
+}
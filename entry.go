@@ -0,0 +1,370 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Cache entries written by Transport are wrapped in an envelope:
+//
+//	magic (4 bytes) | version (1 byte) | CRC-32C of payload (4 bytes) | payload length (8 bytes) | payload
+//
+// In version 2 the payload is a block of metadata in MIME header format,
+// ended by a blank line, followed by the response as dumped by
+// httputil.DumpResponse. In version 1 the payload is only the dumped
+// response, and entries without the magic are raw dumps written by earlier
+// versions, which are read without verification. The metadata of both older
+// forms is recovered from the X-Varied-* headers they kept in the response.
+const (
+	entryMagic     = "\x89HCE"
+	entryVersion   = 2
+	entryHeaderLen = len(entryMagic) + 1 + 4 + 8
+)
+
+// Metadata block keys.
+const (
+	metaStoredAt    = "Stored-At"
+	metaRequestTime = "Request-Time"
+	metaMethod      = "Request-Method"
+	metaURL         = "Request-Url"
+	metaFlags       = "Flags"
+	metaTags        = "Tag"
+	metaVaryPrefix  = "Vary-"
+)
+
+// legacyVaryPrefix prefixes the request header values that entries written
+// before version 2 stored among the response headers.
+const legacyVaryPrefix = "X-Varied-"
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptEntry is returned, wrapped, for cache entries that fail their
+// integrity check or can't be parsed.
+var ErrCorruptEntry = errors.New("httpcache: corrupt cache entry")
+
+// entryFlags are boolean properties of a cache entry.
+type entryFlags uint32
+
+const (
+	// flagRange marks entries stored for a Range request, as allowed by
+	// CacheRangeContextKey.
+	flagRange entryFlags = 1 << iota
+	// flagInvalidated marks entries that were soft purged and must be
+	// revalidated before they are used.
+	flagInvalidated
+)
+
+var entryFlagNames = []struct {
+	flag entryFlags
+	name string
+}{
+	{flagRange, "range"},
+	{flagInvalidated, "invalidated"},
+}
+
+func (f entryFlags) String() string {
+	var names []string
+	for _, fn := range entryFlagNames {
+		if f&fn.flag != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func parseEntryFlags(s string) (f entryFlags) {
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		for _, fn := range entryFlagNames {
+			if fn.name == name {
+				f |= fn.flag
+			}
+		}
+	}
+	return
+}
+
+// entryMeta is the metadata stored with a cached response, kept apart from
+// the response headers returned to callers.
+type entryMeta struct {
+	// StoredAt is when the entry was written.
+	StoredAt time.Time
+	// RequestTime is when the request the response answers was sent.
+	RequestTime time.Time
+	// Method and URL are those of the request.
+	Method string
+	URL    string
+	// Vary holds the values the request had for the headers named by the
+	// response's Vary header.
+	Vary  http.Header
+	Flags entryFlags
+	// Tags are the tags the response was indexed under, if the Transport
+	// has a TagIndex.
+	Tags []string
+}
+
+// newEntryMeta returns the metadata for storing resp as the answer to req,
+// sent at requestTime.
+func newEntryMeta(req *http.Request, resp *http.Response, requestTime time.Time) *entryMeta {
+	meta := &entryMeta{
+		RequestTime: requestTime,
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		Vary:        http.Header{},
+	}
+	for _, varyKey := range headerAllCommaSepValues(resp.Header, "vary") {
+		varyKey = http.CanonicalHeaderKey(varyKey)
+		if reqValue := req.Header.Get(varyKey); varyKey != "" && reqValue != "" {
+			meta.Vary.Set(varyKey, reqValue)
+		}
+	}
+	if req.Context().Value(CacheRangeContextKey) != nil {
+		meta.Flags |= flagRange
+	}
+	return meta
+}
+
+func (m *entryMeta) writeTo(w *bytes.Buffer) {
+	writeField := func(key, value string) {
+		if value != "" {
+			w.WriteString(key + ": " + value + "\r\n")
+		}
+	}
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	writeField(metaStoredAt, formatTime(m.StoredAt))
+	writeField(metaRequestTime, formatTime(m.RequestTime))
+	writeField(metaMethod, m.Method)
+	writeField(metaURL, m.URL)
+	writeField(metaFlags, m.Flags.String())
+	for _, tag := range m.Tags {
+		writeField(metaTags, tag)
+	}
+	for key := range m.Vary {
+		writeField(metaVaryPrefix+key, m.Vary.Get(key))
+	}
+	w.WriteString("\r\n")
+}
+
+// readEntryMeta reads a metadata block from r.
+func readEntryMeta(r *bufio.Reader) (*entryMeta, error) {
+	block, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	parseTime := func(key string) time.Time {
+		t, _ := time.Parse(time.RFC3339Nano, block.Get(key))
+		return t
+	}
+	meta := &entryMeta{
+		StoredAt:    parseTime(metaStoredAt),
+		RequestTime: parseTime(metaRequestTime),
+		Method:      block.Get(metaMethod),
+		URL:         block.Get(metaURL),
+		Flags:       parseEntryFlags(block.Get(metaFlags)),
+		Vary:        http.Header{},
+		Tags:        block.Values(metaTags),
+	}
+	for key := range block {
+		if strings.HasPrefix(key, metaVaryPrefix) {
+			meta.Vary.Set(key[len(metaVaryPrefix):], block.Get(key))
+		}
+	}
+	return meta, nil
+}
+
+// legacyEntryMeta moves the X-Varied-* headers of a response read from an
+// entry written before version 2 into its metadata.
+func legacyEntryMeta(resp *http.Response) *entryMeta {
+	meta := &entryMeta{Vary: http.Header{}}
+	for key := range resp.Header {
+		if strings.HasPrefix(key, legacyVaryPrefix) {
+			meta.Vary.Set(key[len(legacyVaryPrefix):], resp.Header.Get(key))
+			resp.Header.Del(key)
+		}
+	}
+	return meta
+}
+
+// newEntry returns the cache entry for the dumped response respBytes.
+func newEntry(meta *entryMeta, respBytes []byte) io.ReadCloser {
+	var payload bytes.Buffer
+	meta.writeTo(&payload)
+	payload.Write(respBytes)
+
+	header := make([]byte, entryHeaderLen)
+	copy(header, entryMagic)
+	header[len(entryMagic)] = entryVersion
+	binary.BigEndian.PutUint32(header[len(entryMagic)+1:], crc32.Checksum(payload.Bytes(), crc32c))
+	binary.BigEndian.PutUint64(header[len(entryMagic)+5:], uint64(payload.Len()))
+	return ioutil.NopCloser(io.MultiReader(bytes.NewReader(header), &payload))
+}
+
+// entryPayload verifies the cache entry and returns its version and payload.
+// Entries without an envelope are reported as version 0.
+func entryPayload(entry []byte) (version byte, payload []byte, err error) {
+	if !bytes.HasPrefix(entry, []byte(entryMagic)) {
+		return 0, entry, nil
+	}
+	if len(entry) < entryHeaderLen {
+		return 0, nil, fmt.Errorf("%w: truncated header", ErrCorruptEntry)
+	}
+	if version = entry[len(entryMagic)]; version < 1 || version > entryVersion {
+		return 0, nil, fmt.Errorf("%w: unknown version %d", ErrCorruptEntry, version)
+	}
+	sum := binary.BigEndian.Uint32(entry[len(entryMagic)+1:])
+	length := binary.BigEndian.Uint64(entry[len(entryMagic)+5:])
+	payload = entry[entryHeaderLen:]
+	if uint64(len(payload)) != length {
+		return 0, nil, fmt.Errorf("%w: %d bytes, want %d", ErrCorruptEntry, len(payload), length)
+	}
+	if crc32.Checksum(payload, crc32c) != sum {
+		return 0, nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptEntry)
+	}
+	return version, payload, nil
+}
+
+// parsePayload parses the payload of an entry of the given version. If req
+// is nil, the response is parsed as the answer to a request with the method
+// recorded in the metadata, so that HEAD responses aren't read as having a
+// body.
+func parsePayload(version byte, r *bufio.Reader, req *http.Request) (resp *http.Response, meta *entryMeta, err error) {
+	if version >= 2 {
+		if meta, err = readEntryMeta(r); err != nil {
+			return nil, nil, err
+		}
+		if req == nil && meta.Method != "" {
+			req = &http.Request{Method: meta.Method}
+		}
+	}
+	if resp, err = http.ReadResponse(r, req); err != nil {
+		return nil, nil, err
+	}
+	if meta == nil {
+		meta = legacyEntryMeta(resp)
+	}
+	return resp, meta, nil
+}
+
+// readEntry verifies and parses a cache entry into the stored response and
+// its metadata.
+func readEntry(entry io.Reader, req *http.Request) (resp *http.Response, meta *entryMeta, err error) {
+	data, err := ioutil.ReadAll(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	version, payload, err := entryPayload(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, meta, err = parsePayload(version, bufio.NewReader(bytes.NewReader(payload)), req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCorruptEntry, err)
+	}
+	return resp, meta, nil
+}
+
+// ReadEntryHeader parses the status line and headers of the response stored
+// in a cache entry, in the form Transport passes to Cache.Set, without
+// reading or verifying the rest of the entry. Backends use it to inspect the
+// responses they store; the body of the returned response must not be used.
+func ReadEntryHeader(entry io.Reader) (resp *http.Response, err error) {
+	resp, _, err = readEntryHeader(entry)
+	return
+}
+
+// readEntryHeader is like ReadEntryHeader but also returns the entry's
+// metadata.
+func readEntryHeader(entry io.Reader) (resp *http.Response, meta *entryMeta, err error) {
+	r := bufio.NewReader(entry)
+	var version byte
+	if magic, _ := r.Peek(len(entryMagic)); string(magic) == entryMagic {
+		header := make([]byte, entryHeaderLen)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrCorruptEntry, err)
+		}
+		if version = header[len(entryMagic)]; version < 1 || version > entryVersion {
+			return nil, nil, fmt.Errorf("%w: unknown version %d", ErrCorruptEntry, version)
+		}
+	}
+	return parsePayload(version, r, nil)
+}
+
+// SplitEntry splits a cache entry, in the form Transport passes to
+// Cache.Set, into its head, holding everything up to the end of the response
+// headers, and the response body as stored. ok is false if entry isn't a
+// cache entry.
+func SplitEntry(entry []byte) (head, body []byte, ok bool) {
+	offset := 0
+	if bytes.HasPrefix(entry, []byte(entryMagic)) {
+		if len(entry) < entryHeaderLen {
+			return nil, nil, false
+		}
+		offset = entryHeaderLen
+		if entry[len(entryMagic)] >= 2 {
+			// Skip the metadata block.
+			i := bytes.Index(entry[offset:], []byte("\r\n\r\n"))
+			if i < 0 {
+				if !bytes.HasPrefix(entry[offset:], []byte("\r\n")) {
+					return nil, nil, false
+				}
+				i = -2
+			}
+			offset += i + 4
+		}
+	}
+	i := bytes.Index(entry[offset:], []byte("\r\n\r\n"))
+	if i < 0 {
+		return nil, nil, false
+	}
+	offset += i + 4
+	return entry[:offset], entry[offset:], true
+}
+
+// updateEntryFlags rewrites the entry stored as key in c with the flags in
+// set added and those in clear removed. It reports whether a valid entry was
+// found.
+func updateEntryFlags(c Cache, key string, set, clear entryFlags) bool {
+	r, ok := c.Get(key)
+	if !ok {
+		return false
+	}
+	// Entries without metadata don't record their method, but CacheKey
+	// prefixes it to the keys of HEAD requests.
+	var req *http.Request
+	if strings.HasPrefix(key, "HEAD ") {
+		req = &http.Request{Method: "HEAD"}
+	}
+	resp, meta, err := readEntry(r, req)
+	r.Close()
+	if err != nil {
+		return false
+	}
+	flags := meta.Flags&^clear | set
+	if flags == meta.Flags {
+		resp.Body.Close()
+		return true
+	}
+	meta.Flags = flags
+	respBytes, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return false
+	}
+	c.Set(key, newEntry(meta, respBytes))
+	return true
+}
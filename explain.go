@@ -0,0 +1,160 @@
+package httpcache
+
+import (
+	"net/http"
+	"time"
+)
+
+// Sources of the freshness lifetime of a response.
+const (
+	// LifetimeMaxAge is a lifetime given by the max-age directive.
+	LifetimeMaxAge = "max-age"
+	// LifetimeExpires is a lifetime given by the Expires header.
+	LifetimeExpires = "expires"
+	// LifetimeNone means the response has no explicit lifetime. No
+	// heuristic lifetime is assumed, so it is stale as soon as it is stored.
+	LifetimeNone = "none"
+	// LifetimeOption is a lifetime given by the TTL of the request's
+	// Options, in place of the origin's.
+	LifetimeOption = "option"
+)
+
+// Actions a Transport takes for a request.
+const (
+	// ActionServe answers the request from the cache.
+	ActionServe = "serve"
+	// ActionRevalidate sends the request to the origin conditional on the
+	// validators of the cached response.
+	ActionRevalidate = "revalidate"
+	// ActionFetch sends the request to the origin unconditionally.
+	ActionFetch = "fetch"
+	// ActionBypass sends the request to the origin without consulting or
+	// updating the cache.
+	ActionBypass = "bypass"
+	// ActionGatewayTimeout answers the request with a 504, as it has
+	// Cache-Control: only-if-cached and nothing usable is cached.
+	ActionGatewayTimeout = "gateway-timeout"
+)
+
+// An Explanation describes how a Transport treats a response and the
+// request it answers.
+type Explanation struct {
+	// Cacheable reports whether requests like req use the cache at all.
+	Cacheable bool
+	// Storable reports whether the response is stored.
+	Storable bool
+	// Reasons explains why the request isn't cacheable or the response
+	// isn't storable.
+	Reasons []string
+	// Lifetime is how long the response is fresh after its Date, and
+	// LifetimeSource where that comes from.
+	Lifetime       time.Duration
+	LifetimeSource string
+	// Age is how long ago the response was generated by the origin. It is
+	// zero if the response has no Date.
+	Age time.Duration
+	// Freshness is "fresh", "stale" or "transparent" for a request like req
+	// answered by the response once stored.
+	Freshness string
+	// Directives are the Cache-Control directives of the request and the
+	// response that the Transport acts on, prefixed with "request " or
+	// "response ".
+	Directives []string
+	// StaleIfError reports whether the response may be served stale if the
+	// origin fails.
+	StaleIfError bool
+	// Next is what the Transport does with the next request like req, one
+	// of the Action constants.
+	Next string
+}
+
+// knownDirectives are the Cache-Control directives a Transport acts on.
+var knownDirectives = []string{
+	"max-age", "max-stale", "min-fresh", "no-cache", "no-store", "only-if-cached", "stale-if-error",
+}
+
+// Explain describes how a Transport treats resp, the response to req, and
+// the next request like req once resp is cached, including the Options of
+// req. It doesn't take a Transport's CanCache into account.
+func Explain(req *http.Request, resp *http.Response) *Explanation {
+	opts := requestOptions(req)
+	reqCacheControl := parseCacheControl(req.Header)
+	respCacheControl := parseCacheControl(resp.Header)
+	e := &Explanation{
+		Cacheable:      true,
+		LifetimeSource: LifetimeNone,
+		Freshness:      FreshnessToString[getFreshnessWithOptions(resp.Header, req.Header, opts)],
+		StaleIfError:   canStaleOnError(resp.Header, req.Header),
+	}
+
+	if opts.Bypass {
+		e.Cacheable = false
+		e.Reasons = append(e.Reasons, "Bypass option")
+	} else if req.Method != "GET" && req.Method != "HEAD" {
+		e.Cacheable = false
+		e.Reasons = append(e.Reasons, "method "+req.Method)
+	} else if req.Header.Get("range") != "" && req.Context().Value(CacheRangeContextKey) == nil {
+		e.Cacheable = false
+		e.Reasons = append(e.Reasons, "range request")
+	}
+	if e.Cacheable && opts.NoStore {
+		e.Reasons = append(e.Reasons, "NoStore option")
+	} else if e.Cacheable {
+		if reason := notStorableReason(reqCacheControl, respCacheControl, resp); reason != "" {
+			e.Reasons = append(e.Reasons, reason)
+		} else {
+			e.Storable = true
+		}
+	}
+
+	if _, ok := respCacheControl["max-age"]; ok {
+		e.LifetimeSource = LifetimeMaxAge
+	} else if resp.Header.Get("Expires") != "" {
+		e.LifetimeSource = LifetimeExpires
+	}
+	if date, err := Date(resp.Header); err == nil {
+		e.Lifetime = responseLifetime(respCacheControl, resp.Header, date)
+		e.Age = clock.since(date)
+	}
+	if opts.TTL > 0 {
+		e.Lifetime = opts.TTL
+		e.LifetimeSource = LifetimeOption
+	}
+
+	for _, cc := range []struct {
+		prefix string
+		cc     cacheControl
+	}{{"request ", reqCacheControl}, {"response ", respCacheControl}} {
+		for _, name := range knownDirectives {
+			value, ok := cc.cc[name]
+			if !ok {
+				continue
+			}
+			if value != "" {
+				name += "=" + value
+			}
+			e.Directives = append(e.Directives, cc.prefix+name)
+		}
+	}
+
+	_, onlyIfCached := reqCacheControl["only-if-cached"]
+	switch {
+	case !e.Cacheable:
+		e.Next = ActionBypass
+	case opts.Refresh:
+		e.Next = ActionFetch
+	case !e.Storable && (onlyIfCached || opts.CacheOnly):
+		e.Next = ActionGatewayTimeout
+	case !e.Storable:
+		e.Next = ActionFetch
+	case e.Freshness == FreshnessToString[fresh]:
+		e.Next = ActionServe
+	case opts.CacheOnly:
+		e.Next = ActionGatewayTimeout
+	case e.Freshness == FreshnessToString[stale]:
+		e.Next = ActionRevalidate
+	default:
+		e.Next = ActionFetch
+	}
+	return e
+}
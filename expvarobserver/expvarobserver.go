@@ -0,0 +1,98 @@
+// Package expvarobserver provides an httpcache.Observer that publishes the
+// events of a Transport as expvar counters:
+//
+//	lookups        lookups by result
+//	revalidations  revalidations by outcome
+//	stores         responses stored
+//	storedBytes    bytes of the responses stored
+//	evictions      evictions by reason
+//	origin         requests to the origin: requests, errors and the total
+//	               duration in nanoseconds
+//	cache          operations on the cache by operation
+//	cacheDuration  total duration of the operations on the cache in
+//	               nanoseconds by operation
+package expvarobserver
+
+import (
+	"expvar"
+
+	"github.com/mchtech/httpcache"
+)
+
+// Observer is an implementation of httpcache.Observer that counts events in
+// an expvar.Map.
+type Observer struct {
+	lookups       *expvar.Map
+	revalidations *expvar.Map
+	stores        *expvar.Int
+	storedBytes   *expvar.Int
+	evictions     *expvar.Map
+	origin        *expvar.Map
+	cache         *expvar.Map
+	cacheDuration *expvar.Map
+}
+
+// OnLookup implements httpcache.Observer.
+func (o *Observer) OnLookup(e httpcache.LookupEvent) {
+	o.lookups.Add(string(e.Result), 1)
+}
+
+// OnRevalidation implements httpcache.Observer.
+func (o *Observer) OnRevalidation(e httpcache.RevalidationEvent) {
+	o.revalidations.Add(string(e.Outcome), 1)
+}
+
+// OnStore implements httpcache.Observer.
+func (o *Observer) OnStore(e httpcache.StoreEvent) {
+	o.stores.Add(1)
+	o.storedBytes.Add(int64(e.Bytes))
+}
+
+// OnEviction implements httpcache.Observer.
+func (o *Observer) OnEviction(e httpcache.EvictionEvent) {
+	o.evictions.Add(string(e.Reason), 1)
+}
+
+// OnOrigin implements httpcache.Observer.
+func (o *Observer) OnOrigin(e httpcache.OriginEvent) {
+	o.origin.Add("requests", 1)
+	if e.Err != nil {
+		o.origin.Add("errors", 1)
+	}
+	o.origin.Add("durationNanoseconds", int64(e.Duration))
+}
+
+// OnCache implements httpcache.Observer.
+func (o *Observer) OnCache(e httpcache.CacheEvent) {
+	o.cache.Add(string(e.Operation), 1)
+	o.cacheDuration.Add(string(e.Operation), int64(e.Duration))
+}
+
+// New returns an Observer publishing its counters as the expvar name. Like
+// expvar.Publish, it panics if name is already in use.
+func New(name string) *Observer {
+	return NewWithMap(expvar.NewMap(name))
+}
+
+// NewWithMap returns an Observer keeping its counters in m.
+func NewWithMap(m *expvar.Map) *Observer {
+	o := &Observer{
+		lookups:       new(expvar.Map).Init(),
+		revalidations: new(expvar.Map).Init(),
+		stores:        new(expvar.Int),
+		storedBytes:   new(expvar.Int),
+		evictions:     new(expvar.Map).Init(),
+		origin:        new(expvar.Map).Init(),
+		cache:         new(expvar.Map).Init(),
+		cacheDuration: new(expvar.Map).Init(),
+	}
+	m.Set("lookups", o.lookups)
+	m.Set("revalidations", o.revalidations)
+	m.Set("stores", o.stores)
+	m.Set("storedBytes", o.storedBytes)
+	m.Set("evictions", o.evictions)
+	m.Set("origin", o.origin)
+	m.Set("cache", o.cache)
+	m.Set("cacheDuration", o.cacheDuration)
+	return o
+}
@@ -0,0 +1,50 @@
+package expvarobserver
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"testing"
+
+	"github.com/mchtech/httpcache"
+)
+
+func TestObserver(t *testing.T) {
+	m := new(expvar.Map).Init()
+	var o httpcache.Observer = NewWithMap(m)
+	o.OnLookup(httpcache.LookupEvent{Result: httpcache.LookupHit})
+	o.OnLookup(httpcache.LookupEvent{Result: httpcache.LookupHit})
+	o.OnLookup(httpcache.LookupEvent{Result: httpcache.LookupMiss})
+	o.OnRevalidation(httpcache.RevalidationEvent{Outcome: httpcache.RevalidationNotModified})
+	o.OnStore(httpcache.StoreEvent{Bytes: 100})
+	o.OnEviction(httpcache.EvictionEvent{Reason: httpcache.EvictionPurge})
+	o.OnOrigin(httpcache.OriginEvent{Duration: 5, StatusCode: 200})
+	o.OnOrigin(httpcache.OriginEvent{Duration: 7, Err: errors.New("unreachable")})
+	o.OnCache(httpcache.CacheEvent{Operation: httpcache.CacheGet, Duration: 3})
+	o.OnCache(httpcache.CacheEvent{Operation: httpcache.CacheGet, Duration: 4})
+	o.OnCache(httpcache.CacheEvent{Operation: httpcache.CacheSet, Duration: 2})
+
+	var got struct {
+		Lookups       map[string]int
+		Revalidations map[string]int
+		Stores        int
+		StoredBytes   int
+		Evictions     map[string]int
+		Origin        map[string]int
+		Cache         map[string]int
+		CacheDuration map[string]int
+	}
+	if err := json.Unmarshal([]byte(m.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Lookups["hit"] != 2 || got.Lookups["miss"] != 1 || got.Revalidations["not-modified"] != 1 ||
+		got.Stores != 1 || got.StoredBytes != 100 || got.Evictions["purge"] != 1 {
+		t.Fatalf("unexpected counters %s", m)
+	}
+	if got.Origin["requests"] != 2 || got.Origin["errors"] != 1 || got.Origin["durationNanoseconds"] != 12 {
+		t.Fatalf("unexpected origin counters %s", m)
+	}
+	if got.Cache["get"] != 2 || got.Cache["set"] != 1 || got.CacheDuration["get"] != 7 || got.CacheDuration["set"] != 2 {
+		t.Fatalf("unexpected cache counters %s", m)
+	}
+}
@@ -3,20 +3,22 @@
 //
 // It is only suitable for use as a 'private' cache (i.e. for a web-browser or an API-client
 // and not for a shared proxy).
-//
 package httpcache
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -81,6 +83,38 @@ type Cache interface {
 	Delete(key string)
 }
 
+// A Lister is a Cache that can enumerate the keys it holds.
+type Lister interface {
+	// Keys returns the keys of all entries that start with prefix
+	Keys(prefix string) (keys []string)
+}
+
+// A Purger is a Cache that can remove many entries at once.
+type Purger interface {
+	// PurgePrefix removes all entries whose key starts with prefix and
+	// returns how many were removed
+	PurgePrefix(prefix string) (n int)
+}
+
+// A Sizer is a Cache that can report how much it holds.
+type Sizer interface {
+	// Len returns the number of entries
+	Len() (n int)
+	// Size returns the total size of the keys and entries in bytes.
+	// Caches that keep keys out of band, such as in object metadata, may
+	// count only the entries
+	Size() (size int64)
+}
+
+// A ContextCache is a Cache that takes the context of the request it is used
+// for, so that its calls to a remote store can be cancelled and traced.
+type ContextCache interface {
+	// GetContext is Get with the context of the request
+	GetContext(ctx context.Context, key string) (responseBytes io.ReadCloser, ok bool)
+	// SetContext is Set with the context of the request
+	SetContext(ctx context.Context, key string, responseBytes io.ReadCloser)
+}
+
 type contextKey struct {
 	name string
 }
@@ -98,21 +132,74 @@ func CacheKey(req *http.Request) (key string) {
 			return
 		}
 	}()
+	u := req.URL.String()
+	if opts := requestOptions(req); opts.Key != "" {
+		u = opts.Key
+	}
 	if req.Method == http.MethodGet {
-		return req.URL.String()
+		return u
 	} else {
-		return req.Method + " " + req.URL.String()
+		return req.Method + " " + u
 	}
 }
 
+// KeyURL returns the URL part of a cache key, dropping the method that
+// CacheKey prefixes to the keys of requests other than GET.
+func KeyURL(key string) string {
+	if i := strings.IndexByte(key, ' '); i >= 0 {
+		return key[i+1:]
+	}
+	return key
+}
+
 // CachedResponse returns the cached http.Response for req if present, and nil
-// otherwise.
+// otherwise. Entries that are corrupt are deleted from c, and an error
+// wrapping ErrCorruptEntry is returned.
 func CachedResponse(c Cache, req *http.Request) (resp *http.Response, err error) {
-	cachedVal, ok := c.Get(CacheKey(req))
+	key := CacheKey(req)
+	cachedVal, ok := cacheGet(req.Context(), c, key)
+	if !ok {
+		return
+	}
+	defer cachedVal.Close()
+	resp, _, err = readEntry(cachedVal, req)
+	if errors.Is(err, ErrCorruptEntry) {
+		c.Delete(key)
+	}
+	return
+}
+
+// cachedEntry is like CachedResponse for the Cache of t, but also returns
+// the entry's metadata and reports the cache operations.
+func (t *Transport) cachedEntry(ctx context.Context, req *http.Request) (resp *http.Response, meta *entryMeta, err error) {
+	key := CacheKey(req)
+	start := time.Now()
+	cachedVal, ok := cacheGet(ctx, t.Cache, key)
+	t.observeCache(CacheGet, key, start)
 	if !ok {
 		return
 	}
-	return http.ReadResponse(bufio.NewReader(cachedVal), req)
+	defer cachedVal.Close()
+	resp, meta, err = readEntry(cachedVal, req)
+	if errors.Is(err, ErrCorruptEntry) {
+		t.delete(key)
+	}
+	return
+}
+
+// ReadEntry verifies and parses a cache entry, in the form Transport passes to
+// Cache.Set, into the stored response. Backends use it to inspect the
+// responses they store.
+func ReadEntry(entry io.Reader) (resp *http.Response, err error) {
+	resp, _, err = readEntry(entry, nil)
+	return
+}
+
+// SoftPurge marks the entry stored as key in c as stale, so that it is
+// revalidated before it is used again, while keeping it for conditional
+// requests and stale-if-error. It reports whether an entry was found.
+func SoftPurge(c Cache, key string) bool {
+	return updateEntryFlags(c, key, flagInvalidated, 0)
 }
 
 // MemoryCache is an implemtation of Cache that stores responses in an in-memory map.
@@ -153,6 +240,49 @@ func (c *MemoryCache) Delete(key string) {
 	c.mu.Unlock()
 }
 
+// Keys returns the keys of all entries that start with prefix
+func (c *MemoryCache) Keys(prefix string) (keys []string) {
+	c.mu.RLock()
+	for key := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	c.mu.RUnlock()
+	return keys
+}
+
+// PurgePrefix removes all entries whose key starts with prefix
+func (c *MemoryCache) PurgePrefix(prefix string) (n int) {
+	c.mu.Lock()
+	for key := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.items, key)
+			n++
+		}
+	}
+	c.mu.Unlock()
+	return n
+}
+
+// Len returns the number of entries
+func (c *MemoryCache) Len() (n int) {
+	c.mu.RLock()
+	n = len(c.items)
+	c.mu.RUnlock()
+	return n
+}
+
+// Size returns the total size of the keys and entries in bytes
+func (c *MemoryCache) Size() (size int64) {
+	c.mu.RLock()
+	for key, data := range c.items {
+		size += int64(len(key) + len(data))
+	}
+	c.mu.RUnlock()
+	return size
+}
+
 // NewMemoryCache returns a new Cache that will store items in an in-memory map
 func NewMemoryCache() *MemoryCache {
 	c := &MemoryCache{items: map[string][]byte{}}
@@ -170,6 +300,32 @@ type Transport struct {
 	// If true, responses returned from the cache will be given an extra header, X-From-Cache
 	MarkCachedResponses bool
 	CanCache            func(req *http.Request, resp *http.Response) bool
+	// OnCorruptEntry, if set, is called with the key and error of every
+	// cached entry that fails its integrity check. Corrupt entries are deleted
+	// and treated as a miss.
+	OnCorruptEntry func(key string, err error)
+	// Observer, if set, receives events describing what the Transport does.
+	Observer Observer
+	// TagIndex, if set, indexes stored responses by the tags in their
+	// Surrogate-Key and Cache-Tag headers, so that they can be removed with
+	// PurgeTag. It must be a Lister that doesn't expire or evict its
+	// entries, such as a MemoryCache. The index is updated by the Transport
+	// alone, so it can't be shared between processes, and responses removed
+	// from Cache by other means stay in it until PurgeTag finds them gone.
+	TagIndex Cache
+	// Tracer, if set, is used to trace RoundTrip, the cache lookups
+	// and stores, and the requests to the origin. The context of the request
+	// is passed on to caches that are ContextCaches.
+	Tracer Tracer
+	// Logger, if set, receives the decisions RoundTrip takes, such as why a
+	// response was or wasn't served from the cache or stored, at debug
+	// level. See LogDecisionsContextKey.
+	Logger *slog.Logger
+
+	corruptEntries uint64
+	stats          Stats
+	tagMu          [tagLockStripes]sync.Mutex
+	bans           bans
 }
 
 // NewTransport returns a new Transport with the
@@ -178,6 +334,35 @@ func NewTransport(c Cache) *Transport {
 	return &Transport{Cache: c, MarkCachedResponses: true}
 }
 
+// CorruptEntries returns the number of corrupt cache entries the Transport
+// has found.
+func (t *Transport) CorruptEntries() uint64 {
+	return atomic.LoadUint64(&t.corruptEntries)
+}
+
+// Stats holds the counters of a Transport.
+type Stats struct {
+	// Requests is the number of requests made through the Transport.
+	Requests uint64
+	// Hits is the number of responses served from the cache, including
+	// those revalidated with the origin.
+	Hits uint64
+	// Stores is the number of responses written to the cache.
+	Stores uint64
+	// CorruptEntries is the number of corrupt entries found.
+	CorruptEntries uint64
+}
+
+// Stats returns the counters of the Transport.
+func (t *Transport) Stats() Stats {
+	return Stats{
+		Requests:       atomic.LoadUint64(&t.stats.Requests),
+		Hits:           atomic.LoadUint64(&t.stats.Hits),
+		Stores:         atomic.LoadUint64(&t.stats.Stores),
+		CorruptEntries: t.CorruptEntries(),
+	}
+}
+
 // Client returns an *http.Client that caches responses.
 func (t *Transport) Client() *http.Client {
 	return &http.Client{Transport: t}
@@ -185,14 +370,21 @@ func (t *Transport) Client() *http.Client {
 
 // varyMatches will return false unless all of the cached values for the headers listed in Vary
 // match the new request
-func varyMatches(cachedResp *http.Response, req *http.Request) bool {
+func varyMatches(meta *entryMeta, cachedResp *http.Response, req *http.Request) bool {
+	return varyMismatch(meta, cachedResp, req) == ""
+}
+
+// varyMismatch returns the first header named by the Vary header of
+// cachedResp whose value in req differs from the stored one, or "" if there
+// is none.
+func varyMismatch(meta *entryMeta, cachedResp *http.Response, req *http.Request) (header string) {
 	for _, header := range headerAllCommaSepValues(cachedResp.Header, "vary") {
 		header = http.CanonicalHeaderKey(header)
-		if header != "" && req.Header.Get(header) != cachedResp.Header.Get("X-Varied-"+header) {
-			return false
+		if header != "" && req.Header.Get(header) != meta.Vary.Get(header) {
+			return header
 		}
 	}
-	return true
+	return ""
 }
 
 // RoundTrip takes a Request and returns a Response
@@ -206,6 +398,7 @@ func varyMatches(cachedResp *http.Response, req *http.Request) bool {
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 
 	var cachedResp *http.Response
+	var cachedMeta *entryMeta
 
 	var freshness = transparent
 	var staleclient = 1
@@ -213,7 +406,23 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 	var xproxycached = 0
 	var xproxywrite = 0
 
+	var requestTime time.Time
+	lookup := LookupUncacheable
+
+	ctx, span := t.startSpan(req.Context(), "httpcache.RoundTrip")
+	if t.Tracer != nil {
+		span.SetAttributes(Attribute{attrMethod, req.Method}, Attribute{attrURL, req.URL.String()})
+		req = req.WithContext(ctx)
+	}
+
 	defer func() {
+		atomic.AddUint64(&t.stats.Requests, 1)
+		if resp != nil && cachedResp == resp {
+			atomic.AddUint64(&t.stats.Hits, 1)
+		}
+		if xproxywrite == 1 {
+			atomic.AddUint64(&t.stats.Stores, 1)
+		}
 		if t.MarkCachedResponses && resp != nil {
 			if cachedResp == resp {
 				xfromcache = 1
@@ -231,30 +440,114 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 	}()
 
 	cacheKey := CacheKey(req)
+	if t.Tracer != nil {
+		span.SetAttributes(Attribute{attrKey, cacheKey})
+	}
+	defer func() {
+		if t.Tracer != nil {
+			span.SetAttributes(
+				Attribute{attrLookup, string(lookup)},
+				Attribute{attrFreshness, FreshnessToString[freshness]},
+				Attribute{attrStored, xproxywrite == 1},
+			)
+			if resp != nil {
+				span.SetAttributes(Attribute{attrStatus, resp.StatusCode})
+			}
+		}
+		span.End(err)
+	}()
+
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	opts := requestOptions(req)
+	if opts.Bypass {
+		lookup = LookupBypass
+		t.observeLookup(cacheKey, lookup)
+		t.logDecision(req, cacheKey, "bypassed", "Bypass option")
+		resp, _, err = t.fetch(transport, req, cacheKey, false)
+		return resp, err
+	}
+
 	cacheable := (req.Method == "GET" || req.Method == "HEAD") && (req.Header.Get("range") == "" || nil != req.Context().Value(CacheRangeContextKey))
+	if !cacheable {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			t.logDecision(req, cacheKey, "not cached", "method "+req.Method)
+		} else {
+			t.logDecision(req, cacheKey, "not cached", "range request")
+		}
+	}
 
-	if t.CanCache != nil {
-		cacheable = cacheable && t.CanCache(req, resp)
+	if t.CanCache != nil && cacheable {
+		cacheable = t.CanCache(req, resp)
+		if !cacheable {
+			t.logDecision(req, cacheKey, "not cached", "rejected by CanCache")
+		}
 	}
 
-	if cacheable {
-		cachedResp, err = CachedResponse(t.Cache, req)
+	if cacheable && opts.Refresh {
+		lookup = LookupMiss
+		t.logDecision(req, cacheKey, "miss", "Refresh option")
+	} else if cacheable {
+		getCtx, getSpan := t.startSpan(req.Context(), "httpcache.cache.get")
+		cachedResp, cachedMeta, err = t.cachedEntry(getCtx, req)
+		if t.Tracer != nil {
+			getSpan.SetAttributes(Attribute{attrKey, cacheKey}, Attribute{attrFound, cachedResp != nil})
+		}
+		getSpan.End(err)
+		lookup = LookupMiss
+		if errors.Is(err, ErrCorruptEntry) {
+			atomic.AddUint64(&t.corruptEntries, 1)
+			if t.OnCorruptEntry != nil {
+				t.OnCorruptEntry(cacheKey, err)
+			}
+			lookup = LookupCorrupt
+			t.observeEviction(cacheKey, EvictionCorrupt)
+			t.logDecision(req, cacheKey, "miss", "corrupt entry", slog.Any("error", err))
+		}
+		if cachedResp != nil && t.banned(cacheKey, cachedResp, cachedMeta) {
+			cachedResp.Body.Close()
+			cachedResp = nil
+			lookup = LookupBanned
+			t.evict(cacheKey, EvictionBanned)
+			t.logDecision(req, cacheKey, "miss", "banned")
+		} else if cachedResp == nil && lookup == LookupMiss {
+			t.logDecision(req, cacheKey, "miss", "not in cache")
+		}
 	} else {
 		// Need to invalidate an existing value
-		t.Cache.Delete(cacheKey)
-	}
-
-	transport := t.Transport
-	if transport == nil {
-		transport = http.DefaultTransport
+		t.delete(cacheKey)
 	}
 
 	if cacheable && cachedResp != nil && err == nil {
 		xproxycached = 1
-		if varyMatches(cachedResp, req) {
+		if header := varyMismatch(cachedMeta, cachedResp, req); header == "" {
 			// Can only use cached value if the new request doesn't Vary significantly
-			freshness = getFreshness(cachedResp.Header, req.Header)
+			freshness = getFreshnessWithOptions(cachedResp.Header, req.Header, opts)
+			if cachedMeta.Flags&flagInvalidated != 0 && freshness == fresh {
+				// Soft purged.
+				freshness = stale
+				t.logDecision(req, cacheKey, "stale", "soft purged")
+			}
+			switch freshness {
+			case fresh:
+				lookup = LookupHit
+				t.logDecision(req, cacheKey, "hit", "fresh")
+			case stale:
+				lookup = LookupStale
+			default:
+				lookup = LookupTransparent
+				t.logDecision(req, cacheKey, "bypassed", "request has Cache-Control: no-cache")
+			}
 			if freshness == fresh {
+				t.observeLookup(cacheKey, lookup)
+				if opts.CacheOnly && getFreshnessWithOptions(cachedResp.Header, req.Header, Options{TTL: opts.TTL, MaxStale: opts.MaxStale}) != fresh {
+					// Served only because of CacheOnly, so the request's
+					// validators may not match.
+					return cachedResp, nil
+				}
 				staleclient = -1
 				cachedResp.StatusCode = http.StatusNotModified
 				cachedResp.Status = http.StatusText(http.StatusNotModified)
@@ -288,12 +581,31 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 				}
 				if req2 != nil {
 					req = req2
+					t.logDecision(req, cacheKey, "stale", "revalidating",
+						slog.String("etag", etag), slog.String("lastModified", lastModified))
+				} else {
+					t.logDecision(req, cacheKey, "stale", "no validators to revalidate with")
 				}
 			}
+		} else {
+			lookup = LookupVaryMismatch
+			t.logDecision(req, cacheKey, "miss", "vary mismatch on "+header)
+		}
+		t.observeLookup(cacheKey, lookup)
+		if opts.CacheOnly {
+			cachedResp.Body.Close()
+			xproxycached = 0
+			t.logDecision(req, cacheKey, "gateway timeout", "CacheOnly option and nothing usable in cache")
+			return newGatewayTimeoutResponse(req), nil
 		}
+		revalidating := staleclient == 0
 
-		resp, err = transport.RoundTrip(req)
+		resp, requestTime, err = t.fetch(transport, req, cacheKey, revalidating)
 		if err == nil && (req.Method == "GET" || req.Method == "HEAD") && resp.StatusCode == http.StatusNotModified {
+			if revalidating {
+				t.observeRevalidation(cacheKey, RevalidationNotModified)
+				t.logDecision(req, cacheKey, "revalidated", "not modified")
+			}
 			// Replace the 304 response with the one from cache, but update with some new headers
 			endToEndHeaders := getEndToEndHeaders(resp.Header)
 			for _, header := range endToEndHeaders {
@@ -303,6 +615,10 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 				cachedResp.Header[header] = resp.Header[header]
 			}
 			resp.Body.Close()
+			if cachedMeta.Flags&flagInvalidated != 0 {
+				// Revalidated after a soft purge.
+				updateEntryFlags(t.Cache, cacheKey, 0, flagInvalidated)
+			}
 			if staleclient == 1 {
 				cachedResp.StatusCode = http.StatusNotModified
 				cachedResp.Status = http.StatusText(http.StatusNotModified)
@@ -312,32 +628,70 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 			(req.Method == "GET" || req.Method == "HEAD") && canStaleOnError(cachedResp.Header, req.Header) {
 			// In case of transport failure and stale-if-error activated, returns cached content
 			// when available
+			if t.Tracer != nil {
+				event := []Attribute{{attrKey, cacheKey}}
+				if err != nil {
+					event = append(event, Attribute{attrError, err.Error()})
+				} else {
+					event = append(event, Attribute{attrStatus, resp.StatusCode})
+				}
+				span.AddEvent("httpcache.serve_stale", event...)
+			}
 			if resp != nil && resp.Body != nil {
 				resp.Body.Close()
 			}
+			if revalidating {
+				t.observeRevalidation(cacheKey, RevalidationStaleOnError)
+			}
+			if err != nil {
+				t.logDecision(req, cacheKey, "served stale", "stale-if-error", slog.Any("error", err))
+			} else {
+				t.logDecision(req, cacheKey, "served stale", "stale-if-error", slog.Int("status", resp.StatusCode))
+			}
 			return cachedResp, nil
 		} else {
+			if revalidating {
+				if err != nil || resp.StatusCode >= 500 {
+					t.observeRevalidation(cacheKey, RevalidationError)
+				} else {
+					t.observeRevalidation(cacheKey, RevalidationModified)
+				}
+			}
 			if err != nil || resp.StatusCode != http.StatusOK {
 				xproxycached = 0
-				t.Cache.Delete(cacheKey)
+				t.evict(cacheKey, EvictionRevalidationFailed)
+				cachedResp = nil
+				if err != nil {
+					t.logDecision(req, cacheKey, "evicted", "revalidation failed", slog.Any("error", err))
+				} else {
+					t.logDecision(req, cacheKey, "evicted", "revalidation failed", slog.Int("status", resp.StatusCode))
+				}
 			}
 			if err != nil {
 				return nil, err
 			}
 		}
 	} else {
+		t.observeLookup(cacheKey, lookup)
 		xproxycached = 0
 		reqCacheControl := parseCacheControl(req.Header)
 		if _, ok := reqCacheControl["only-if-cached"]; ok {
 			resp = newGatewayTimeoutResponse(req)
+			t.logDecision(req, cacheKey, "gateway timeout", "only-if-cached and nothing usable in cache")
+		} else if opts.CacheOnly {
+			resp = newGatewayTimeoutResponse(req)
+			t.logDecision(req, cacheKey, "gateway timeout", "CacheOnly option and nothing usable in cache")
 		} else {
-			resp, err = transport.RoundTrip(req)
+			resp, requestTime, err = t.fetch(transport, req, cacheKey, false)
 			if err != nil {
 				return nil, err
 			}
 		}
-		if t.CanCache != nil {
-			cacheable = cacheable && t.CanCache(req, resp)
+		if t.CanCache != nil && cacheable {
+			cacheable = t.CanCache(req, resp)
+			if !cacheable {
+				t.logDecision(req, cacheKey, "not stored", "rejected by CanCache")
+			}
 		}
 	}
 
@@ -351,16 +705,30 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		resp.ContentLength = 0
 	}
 
-	if cacheable && canStore(parseCacheControl(req.Header), parseCacheControl(resp.Header), resp) {
-		for _, varyKey := range headerAllCommaSepValues(resp.Header, "vary") {
-			varyKey = http.CanonicalHeaderKey(varyKey)
-			fakeHeader := "X-Varied-" + varyKey
-			reqValue := req.Header.Get(varyKey)
-			if reqValue != "" {
-				resp.Header.Set(fakeHeader, reqValue)
-			}
+	if opts.NoStore {
+		if cacheable {
+			t.logDecision(req, cacheKey, "not stored", "NoStore option")
 		}
+		return resp, nil
+	}
+
+	var notStorable string
+	if cacheable {
+		notStorable = notStorableReason(parseCacheControl(req.Header), parseCacheControl(resp.Header), resp)
+		if notStorable != "" {
+			t.logDecision(req, cacheKey, "not stored", notStorable)
+		}
+	}
+	if cacheable && notStorable == "" {
+		meta := newEntryMeta(req, resp, requestTime)
+		if t.TagIndex != nil {
+			meta.Tags = responseTags(resp.Header)
+		}
+		// GET responses are stored once read, possibly after the request
+		// has been cancelled.
+		storeCtx := context.WithoutCancel(req.Context())
 		if staleclient == 1 && resp.StatusCode == http.StatusNotModified {
+			t.logDecision(req, cacheKey, "not stored", "304 to the request's own validators")
 			return resp, nil
 		}
 		if resp != cachedResp {
@@ -375,20 +743,30 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 						resp.Body = ioutil.NopCloser(r)
 						respBytes, err := httputil.DumpResponse(&resp, true)
 						if err == nil {
-							t.Cache.Set(cacheKey, ioutil.NopCloser(bytes.NewReader(respBytes)))
+							meta.StoredAt = time.Now()
+							t.store(storeCtx, cacheKey, newEntry(meta, respBytes), meta.Tags)
+							t.observeStore(cacheKey, len(respBytes))
+							t.logDecision(req, cacheKey, "stored", "", slog.Int("bytes", len(respBytes)))
 						}
 					},
 				}
 			default:
 				respBytes, err := httputil.DumpResponse(resp, true)
 				if err == nil {
-					t.Cache.Set(cacheKey, ioutil.NopCloser(bytes.NewReader(respBytes)))
+					meta.StoredAt = time.Now()
+					t.store(storeCtx, cacheKey, newEntry(meta, respBytes), meta.Tags)
+					t.observeStore(cacheKey, len(respBytes))
+					t.logDecision(req, cacheKey, "stored", "", slog.Int("bytes", len(respBytes)))
 				}
 			}
 		}
 	} else {
 		xproxycached = 0
-		t.Cache.Delete(cacheKey)
+		if cachedResp != nil {
+			t.evict(cacheKey, EvictionUncacheable)
+		} else {
+			t.delete(cacheKey)
+		}
 	}
 	return resp, nil
 }
@@ -429,6 +807,11 @@ var clock timer = &realClock{}
 // Because this is only a private cache, 'public' and 'private' in cache-control aren't
 // signficant. Similarly, smax-age isn't used.
 func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
+	return getFreshnessWithOptions(respHeaders, reqHeaders, Options{})
+}
+
+// getFreshnessWithOptions is getFreshness for a request with opts.
+func getFreshnessWithOptions(respHeaders, reqHeaders http.Header, opts Options) (freshness int) {
 	respCacheControl := parseCacheControl(respHeaders)
 	reqCacheControl := parseCacheControl(reqHeaders)
 	if _, ok := reqCacheControl["no-cache"]; ok {
@@ -437,7 +820,7 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 	if _, ok := respCacheControl["no-cache"]; ok {
 		return stale
 	}
-	if _, ok := reqCacheControl["only-if-cached"]; ok {
+	if _, ok := reqCacheControl["only-if-cached"]; ok || opts.CacheOnly {
 		return fresh
 	}
 
@@ -447,27 +830,11 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 	}
 	currentAge := clock.since(date)
 
-	var lifetime time.Duration
-	var zeroDuration time.Duration
-
-	// If a response includes both an Expires header and a max-age directive,
-	// the max-age directive overrides the Expires header, even if the Expires header is more restrictive.
-	if maxAge, ok := respCacheControl["max-age"]; ok {
-		lifetime, err = time.ParseDuration(maxAge + "s")
-		if err != nil {
-			lifetime = zeroDuration
-		}
-	} else {
-		expiresHeader := respHeaders.Get("Expires")
-		if expiresHeader != "" {
-			expires, err := time.Parse(time.RFC1123, expiresHeader)
-			if err != nil {
-				lifetime = zeroDuration
-			} else {
-				lifetime = expires.Sub(date)
-			}
-		}
+	lifetime := responseLifetime(respCacheControl, respHeaders, date)
+	if opts.TTL > 0 {
+		lifetime = opts.TTL
 	}
+	var zeroDuration time.Duration
 
 	if maxAge, ok := reqCacheControl["max-age"]; ok {
 		// the client is willing to accept a response whose age is no greater than the specified time in seconds
@@ -501,6 +868,9 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 			currentAge = time.Duration(currentAge - maxstaleDuration)
 		}
 	}
+	if opts.MaxStale > 0 {
+		currentAge -= opts.MaxStale
+	}
 
 	if lifetime > currentAge {
 		var fe, fl bool
@@ -523,6 +893,46 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 	return stale
 }
 
+// responseLifetime returns the freshness lifetime the origin assigned to a
+// response dated date.
+func responseLifetime(respCacheControl cacheControl, respHeaders http.Header, date time.Time) (lifetime time.Duration) {
+	// If a response includes both an Expires header and a max-age directive,
+	// the max-age directive overrides the Expires header, even if the Expires header is more restrictive.
+	if maxAge, ok := respCacheControl["max-age"]; ok {
+		lifetime, err := time.ParseDuration(maxAge + "s")
+		if err != nil {
+			return 0
+		}
+		return lifetime
+	}
+	expiresHeader := respHeaders.Get("Expires")
+	if expiresHeader != "" {
+		expires, err := time.Parse(time.RFC1123, expiresHeader)
+		if err != nil {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	return 0
+}
+
+// ExpiresAt returns the time at which a response with respHeaders stops being
+// fresh, ignoring any request directives. ok is false if the response has no
+// Date header, in which case it is never fresh.
+//
+// Cache backends use it to derive expiry times for the entries they store.
+func ExpiresAt(respHeaders http.Header) (expires time.Time, ok bool) {
+	date, err := Date(respHeaders)
+	if err != nil {
+		return
+	}
+	respCacheControl := parseCacheControl(respHeaders)
+	if _, ok := respCacheControl["no-cache"]; ok {
+		return date, true
+	}
+	return date.Add(responseLifetime(respCacheControl, respHeaders, date)), true
+}
+
 // Returns true if either the request or the response includes the stale-if-error
 // cache control extension: https://tools.ietf.org/html/rfc5861
 func canStaleOnError(respHeaders, reqHeaders http.Header) bool {
@@ -596,16 +1006,21 @@ func getEndToEndHeaders(respHeaders http.Header) []string {
 }
 
 func canStore(reqCacheControl, respCacheControl cacheControl, resp *http.Response) (canStore bool) {
+	return notStorableReason(reqCacheControl, respCacheControl, resp) == ""
+}
+
+// notStorableReason returns why resp can't be stored, or "" if it can.
+func notStorableReason(reqCacheControl, respCacheControl cacheControl, resp *http.Response) string {
 	if _, ok := respCacheControl["no-store"]; ok {
-		return false
+		return "response has Cache-Control: no-store"
 	}
 	if _, ok := reqCacheControl["no-store"]; ok {
-		return false
+		return "request has Cache-Control: no-store"
 	}
 	if resp.Header.Get("etag") == "" && resp.Header.Get("last-modified") == "" {
-		return false
+		return "no validators"
 	}
-	return true
+	return ""
 }
 
 func newGatewayTimeoutResponse(req *http.Request) *http.Response {
@@ -2,14 +2,19 @@ package httpcache
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -1127,6 +1132,30 @@ func TestMaxStaleValue(t *testing.T) {
 	}
 }
 
+func TestExpiresAt(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	respHeaders := http.Header{}
+	if _, ok := ExpiresAt(respHeaders); ok {
+		t.Fatal("got expiry for response without date")
+	}
+
+	respHeaders.Set("date", now.Format(time.RFC1123))
+	respHeaders.Set("expires", now.Add(time.Hour).Format(time.RFC1123))
+	if expires, _ := ExpiresAt(respHeaders); !expires.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expires = %v, want %v", expires, now.Add(time.Hour))
+	}
+
+	respHeaders.Set("cache-control", "max-age=60")
+	if expires, _ := ExpiresAt(respHeaders); !expires.Equal(now.Add(time.Minute)) {
+		t.Fatalf("max-age doesn't override expires: %v", expires)
+	}
+
+	respHeaders.Set("cache-control", "no-cache, max-age=60")
+	if expires, _ := ExpiresAt(respHeaders); !expires.Equal(now) {
+		t.Fatalf("no-cache response expires at %v, want %v", expires, now)
+	}
+}
+
 func containsHeader(headers []string, header string) bool {
 	for _, v := range headers {
 		if http.CanonicalHeaderKey(v) == http.CanonicalHeaderKey(header) {
@@ -1452,6 +1481,824 @@ func TestStaleIfErrorKeepsStatus(t *testing.T) {
 // In the past, that required CancelRequest to be implemented correctly,
 // but modern http.Client uses Request.Cancel (or request context) instead,
 // so we don't have to do anything.
+func TestCorruptEntry(t *testing.T) {
+	resetTest()
+	tmock := transportMock{
+		response: &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Date": []string{time.Now().Format(time.RFC1123)},
+				"Etag": []string{`"abc"`},
+			},
+			Body: ioutil.NopCloser(bytes.NewBuffer([]byte("some data"))),
+		},
+	}
+	cache := NewMemoryCache()
+	tp := NewTransport(cache)
+	tp.Transport = &tmock
+	var corruptKey string
+	tp.OnCorruptEntry = func(key string, err error) {
+		if !errors.Is(err, ErrCorruptEntry) {
+			t.Errorf("got error %v, want ErrCorruptEntry", err)
+		}
+		corruptKey = key
+	}
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	resp, err := tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	if _, err := CachedResponse(cache, r); err != nil {
+		t.Fatalf("stored entry fails verification: %v", err)
+	}
+
+	// Flip a bit in the body of the stored entry.
+	key := CacheKey(r)
+	cache.mu.Lock()
+	entry := cache.items[key]
+	entry[len(entry)-1] ^= 1
+	cache.mu.Unlock()
+
+	tmock.response.Body = ioutil.NopCloser(bytes.NewBuffer([]byte("some data")))
+	if _, err := tp.RoundTrip(r); err != nil {
+		t.Fatal(err)
+	}
+	if tp.CorruptEntries() != 1 || corruptKey != key {
+		t.Fatalf("corruption not reported: count %d, key %q", tp.CorruptEntries(), corruptKey)
+	}
+
+	cache.Set(key, ioutil.NopCloser(bytes.NewReader([]byte("garbage"))))
+	if _, err := CachedResponse(cache, r); !errors.Is(err, ErrCorruptEntry) {
+		t.Fatalf("got error %v, want ErrCorruptEntry", err)
+	}
+	if cache.Has(key) {
+		t.Fatal("corrupt entry not deleted")
+	}
+}
+
+func TestEntryMetadata(t *testing.T) {
+	resetTest()
+	tmock := transportMock{
+		response: &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=3600"},
+				"Etag":          []string{`"abc"`},
+				"Vary":          []string{"Accept"},
+			},
+			Body: ioutil.NopCloser(bytes.NewBuffer([]byte("some data"))),
+		},
+	}
+	cache := NewMemoryCache()
+	tp := NewTransport(cache)
+	tp.Transport = &tmock
+
+	before := time.Now()
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	r.Header.Set("Accept", "text/plain")
+	resp, err := tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+
+	cachedResp, meta, err := tp.cachedEntry(r.Context(), r)
+	if err != nil || cachedResp == nil {
+		t.Fatalf("got %v, %v", cachedResp, err)
+	}
+	if got := cachedResp.Header.Get("X-Varied-Accept"); got != "" {
+		t.Fatalf("metadata leaked into headers: X-Varied-Accept: %s", got)
+	}
+	if meta.Method != "GET" || meta.URL != "http://somewhere.com/" {
+		t.Fatalf("got request %s %s", meta.Method, meta.URL)
+	}
+	if got := meta.Vary.Get("Accept"); got != "text/plain" {
+		t.Fatalf("got vary value %q, want text/plain", got)
+	}
+	if meta.RequestTime.Before(before) || meta.StoredAt.Before(meta.RequestTime) {
+		t.Fatalf("got request time %v, stored at %v", meta.RequestTime, meta.StoredAt)
+	}
+
+	// Entries written before the metadata header keep the vary values in
+	// the response headers.
+	legacy := "HTTP/1.1 200 OK\r\nVary: Accept\r\nX-Varied-Accept: text/html\r\nContent-Length: 0\r\n\r\n"
+	cache.Set(CacheKey(r), ioutil.NopCloser(bytes.NewBufferString(legacy)))
+	cachedResp, meta, err = tp.cachedEntry(r.Context(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedResp.Header.Get("X-Varied-Accept"); got != "" {
+		t.Fatalf("legacy metadata leaked into headers: X-Varied-Accept: %s", got)
+	}
+	if varyMatches(meta, cachedResp, r) {
+		t.Fatal("legacy entry for text/html matches request for text/plain")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	resetTest()
+	cache := NewMemoryCache()
+	tp := NewTransport(cache)
+	for _, key := range []string{
+		"http://a.com/x",
+		"HEAD http://a.com/x",
+		"http://a.com/x-bytes=0-99",
+		"http://a.com/x-y",
+		"http://a.com/y",
+		"http://a.com",
+		"https://a.com/z?q=1",
+		"http://a.com:8080/x",
+		"http://b.com/x",
+	} {
+		cache.Set(key, ioutil.NopCloser(bytes.NewBufferString("entry")))
+	}
+
+	if n := tp.PurgeURL("http://a.com/x"); n != 3 {
+		t.Fatalf("PurgeURL() removed %d entries, want 3", n)
+	}
+	if !cache.Has("http://a.com/x-y") {
+		t.Fatal("PurgeURL() removed another URL")
+	}
+	if n, err := tp.PurgePrefix("http://a.com/x"); err != nil || n != 1 {
+		t.Fatalf("PurgePrefix() = %d, %v, want 1", n, err)
+	}
+	if n, err := tp.PurgeHost("a.com"); err != nil || n != 3 {
+		t.Fatalf("PurgeHost() = %d, %v, want 3", n, err)
+	}
+	if keys := cache.Keys(""); len(keys) != 2 {
+		t.Fatalf("remaining keys %q, want the other hosts' only", keys)
+	}
+
+	// Caches that can't enumerate their entries only support PurgeURL.
+	tp = NewTransport(struct{ Cache }{cache})
+	if n := tp.PurgeURL("http://b.com/x"); n != 1 {
+		t.Fatalf("PurgeURL() removed %d entries, want 1", n)
+	}
+	if _, err := tp.PurgeHost("a.com:8080"); err != ErrNotSupported {
+		t.Fatalf("PurgeHost() error = %v, want ErrNotSupported", err)
+	}
+}
+
+func TestPurgeTag(t *testing.T) {
+	resetTest()
+	cache, tags := NewMemoryCache(), NewMemoryCache()
+	tp := NewTransport(cache)
+	tp.TagIndex = tags
+	get := func(url string, header http.Header) {
+		tp.Transport = &transportMock{
+			response: &http.Response{
+				Status:     http.StatusText(http.StatusOK),
+				StatusCode: http.StatusOK,
+				Header:     header,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("some data")),
+			},
+		}
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Cache-Control", "no-cache")
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+	}
+	index := func(tag string) string {
+		prefix := tagIndexPrefix + tag + "\x00"
+		var keys []string
+		for _, key := range tags.Keys(prefix) {
+			keys = append(keys, key[len(prefix):])
+		}
+		sort.Strings(keys)
+		return strings.Join(keys, "\n")
+	}
+
+	get("http://a.com/", http.Header{"Etag": {`"a"`}, "Surrogate-Key": {"red  blue"}})
+	get("http://b.com/", http.Header{"Etag": {`"b"`}, "Cache-Tag": {"blue, green"}})
+	if got := index("blue"); got != "http://a.com/\nhttp://b.com/" {
+		t.Fatalf("blue index = %q", got)
+	}
+
+	get("http://a.com/", http.Header{"Etag": {`"a2"`}, "Surrogate-Key": {"green"}})
+	if got := index("red"); got != "" {
+		t.Fatalf("red index not cleared on overwrite: %q", got)
+	}
+	if got := index("green"); got != "http://a.com/\nhttp://b.com/" {
+		t.Fatalf("green index = %q", got)
+	}
+
+	get("http://b.com/", http.Header{"Cache-Tag": {"blue"}})
+	if cache.Has("http://b.com/") || index("blue") != "" || index("green") != "http://a.com/" {
+		t.Fatalf("index not updated on delete: blue %q, green %q", index("blue"), index("green"))
+	}
+
+	if n := tp.PurgeTag("green"); n != 1 || cache.Has("http://a.com/") || cache.Len() != 0 {
+		t.Fatalf("PurgeTag() removed %d entries, %d left", n, cache.Len())
+	}
+	if n := tags.Len(); n != 0 {
+		t.Fatalf("%d index entries left after purging every tagged response", n)
+	}
+
+	// A response replaced other than through the Transport is dropped from
+	// the index of the tag it no longer has.
+	get("http://a.com/", http.Header{"Etag": {`"a"`}, "Surrogate-Key": {"red"}})
+	other := NewTransport(cache)
+	other.Transport = &transportMock{response: &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Etag": {`"a2"`}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString("some data")),
+	}}
+	req, _ := http.NewRequest("GET", "http://a.com/", nil)
+	req.Header.Set("Cache-Control", "no-cache")
+	resp, err := other.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	if n := tp.PurgeTag("red"); n != 0 || !cache.Has("http://a.com/") || index("red") != "" {
+		t.Fatalf("PurgeTag() removed %d entries no longer tagged, index %q", n, index("red"))
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSoftPurge(t *testing.T) {
+	resetTest()
+	var upstream []*http.Request
+	var upstreamErr error
+	status := http.StatusOK
+	cache := NewMemoryCache()
+	tp := NewTransport(cache)
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		upstream = append(upstream, req)
+		if upstreamErr != nil {
+			return nil, upstreamErr
+		}
+		body := "some data"
+		if req.Method == "HEAD" {
+			body = ""
+		}
+		return &http.Response{
+			Status:     http.StatusText(status),
+			StatusCode: status,
+			Header: http.Header{
+				"Date":           {time.Now().Format(time.RFC1123)},
+				"Cache-Control":  {"max-age=3600, stale-if-error"},
+				"Content-Length": {"9"},
+				"Etag":           {`"abc"`},
+			},
+			ContentLength: 9,
+			Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
+			Request:       req,
+		}, nil
+	})
+	// get makes a conditional request for the cached version, which is
+	// answered from the cache while it is fresh.
+	request := func(method string) *http.Response {
+		req, _ := http.NewRequest(method, "http://somewhere.com/", nil)
+		req.Header.Set("If-None-Match", `"abc"`)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		return resp
+	}
+	get := func() *http.Response { return request("GET") }
+
+	get()
+	get()
+	if len(upstream) != 1 {
+		t.Fatalf("fresh entry not served from cache: %d upstream requests", len(upstream))
+	}
+
+	if n := tp.SoftPurgeURL("http://somewhere.com/"); n != 1 {
+		t.Fatalf("SoftPurgeURL() marked %d entries, want 1", n)
+	}
+	if !cache.Has("http://somewhere.com/") {
+		t.Fatal("soft purged entry removed")
+	}
+	status = http.StatusNotModified
+	if resp := get(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("revalidated soft purged entry returned status %d", resp.StatusCode)
+	}
+	if len(upstream) != 2 || upstream[1].Header.Get("If-None-Match") != `"abc"` {
+		t.Fatal("soft purged entry not revalidated")
+	}
+	if resp := get(); len(upstream) != 2 || resp.StatusCode != http.StatusNotModified {
+		t.Fatal("revalidated entry still treated as stale")
+	}
+
+	SoftPurge(cache, "http://somewhere.com/")
+	upstreamErr = errors.New("unreachable")
+	if resp := get(); len(upstream) != 3 || resp.StatusCode != http.StatusOK {
+		t.Fatal("soft purged entry not served on error")
+	}
+
+	// HEAD responses are stored under their own key and soft purged too.
+	upstreamErr = nil
+	status = http.StatusOK
+	request("HEAD")
+	request("HEAD")
+	if len(upstream) != 4 {
+		t.Fatalf("fresh HEAD entry not served from cache: %d upstream requests", len(upstream))
+	}
+	if n := tp.SoftPurgeURL("http://somewhere.com/"); n != 2 {
+		t.Fatalf("SoftPurgeURL() marked %d entries, want 2", n)
+	}
+	status = http.StatusNotModified
+	request("HEAD")
+	if len(upstream) != 5 || upstream[4].Method != "HEAD" {
+		t.Fatal("soft purged HEAD entry not revalidated")
+	}
+}
+
+func TestBan(t *testing.T) {
+	resetTest()
+	var upstream []*http.Request
+	cache := NewMemoryCache()
+	tp := NewTransport(cache)
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		upstream = append(upstream, req)
+		contentType := "application/json"
+		if strings.HasPrefix(req.URL.Path, "/static") {
+			contentType = "text/plain"
+		}
+		return &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Cache-Control": {"max-age=3600"},
+				"Content-Type":  {contentType},
+				"Etag":          {`"abc"`},
+			},
+			Body: ioutil.NopCloser(bytes.NewBufferString("some data")),
+		}, nil
+	})
+	// get reports whether the request was revalidated, rather than sent
+	// unconditionally.
+	get := func(path string) (revalidated bool) {
+		req, _ := http.NewRequest("GET", "http://somewhere.com"+path, nil)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		return upstream[len(upstream)-1].Header.Get("If-None-Match") != ""
+	}
+	for _, path := range []string{"/api/v1/users/1", "/api/v1/posts", "/static/a"} {
+		get(path)
+	}
+
+	if err := tp.Ban("req.url ~ ^/api/v1/users"); err != nil {
+		t.Fatal(err)
+	}
+	if get("/api/v1/users/1") {
+		t.Fatal("banned entry used")
+	}
+	if !get("/api/v1/posts") {
+		t.Fatal("entry not matching the ban treated as a miss")
+	}
+	if !get("/api/v1/users/1") {
+		t.Fatal("entry stored after the ban treated as a miss")
+	}
+
+	if err := tp.Ban(`req.host == somewhere.com && resp.header.Content-Type == "application/json"`); err != nil {
+		t.Fatal(err)
+	}
+	if n := tp.Lurk(); n != 2 {
+		t.Fatalf("Lurk() removed %d entries, want 2", n)
+	}
+	if cache.Has("http://somewhere.com/api/v1/posts") || !cache.Has("http://somewhere.com/static/a") {
+		t.Fatal("Lurk() removed the wrong entries")
+	}
+	if bans := tp.Bans(); len(bans) != 0 {
+		t.Fatalf("bans not retired after a full pass: %v", bans)
+	}
+
+	// A pass that doesn't list every entry keeps the ban for the lazy check.
+	tp.Cache = partialLister{cache}
+	get("/api/v1/posts")
+	get("/api/v1/users/1")
+	if err := tp.Ban("req.url ~ ^/api"); err != nil {
+		t.Fatal(err)
+	}
+	if n := tp.Lurk(); n != 1 {
+		t.Fatalf("Lurk() removed %d entries, want 1", n)
+	}
+	if bans := tp.Bans(); len(bans) != 1 {
+		t.Fatalf("bans after a partial pass: %v", bans)
+	}
+	if get("/api/v1/posts") {
+		t.Fatal("banned entry missed by Lurk used")
+	}
+
+	for _, expr := range []string{"req.url", "req.path == /", "resp.status ~ (", "req.url == /a && "} {
+		if err := tp.Ban(expr); err == nil {
+			t.Errorf("Ban(%q) accepted an invalid expression", expr)
+		}
+	}
+}
+
+// partialLister is a MemoryCache whose Keys leaves out the first entry.
+type partialLister struct {
+	*MemoryCache
+}
+
+func (c partialLister) Keys(prefix string) []string {
+	keys := c.MemoryCache.Keys(prefix)
+	sort.Strings(keys)
+	if len(keys) > 0 {
+		keys = keys[1:]
+	}
+	return keys
+}
+
+type recordingObserver struct {
+	events []string
+}
+
+func (o *recordingObserver) OnLookup(e LookupEvent) {
+	o.events = append(o.events, "lookup "+string(e.Result))
+}
+
+func (o *recordingObserver) OnRevalidation(e RevalidationEvent) {
+	o.events = append(o.events, "revalidation "+string(e.Outcome))
+}
+
+func (o *recordingObserver) OnStore(e StoreEvent) {
+	o.events = append(o.events, "store "+strconv.Itoa(e.Bytes))
+}
+
+func (o *recordingObserver) OnEviction(e EvictionEvent) {
+	o.events = append(o.events, "eviction "+string(e.Reason))
+}
+
+func (o *recordingObserver) OnOrigin(e OriginEvent) {
+	o.events = append(o.events, "origin "+strconv.Itoa(e.StatusCode))
+}
+
+func (o *recordingObserver) OnCache(e CacheEvent) {
+	o.events = append(o.events, "cache "+string(e.Operation))
+}
+
+func TestObserver(t *testing.T) {
+	resetTest()
+	status := http.StatusOK
+	cache := NewMemoryCache()
+	tp := NewTransport(cache)
+	observer := &recordingObserver{}
+	tp.Observer = observer
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			Status:     http.StatusText(status),
+			StatusCode: status,
+			Header: http.Header{
+				"Cache-Control": {"max-age=3600"},
+				"Etag":          {`"abc"`},
+			},
+			Body: ioutil.NopCloser(bytes.NewBufferString("some data")),
+		}, nil
+	})
+	get := func(method string) []string {
+		observer.events = nil
+		req, _ := http.NewRequest(method, "http://somewhere.com/", nil)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		return observer.events
+	}
+	check := func(got []string, want ...string) {
+		t.Helper()
+		if strings.Join(got, ", ") != strings.Join(want, ", ") {
+			t.Errorf("got events %q, want %q", got, want)
+		}
+	}
+
+	check(get("GET"), "cache get", "lookup miss", "origin 200", "cache set", "store 140")
+	status = http.StatusNotModified
+	check(get("GET"), "cache get", "lookup stale", "origin 304", "revalidation not-modified")
+	check(get("POST"), "cache delete", "lookup uncacheable", "origin 304", "cache delete")
+	status = http.StatusInternalServerError
+	// The error response has validators, so it replaces the evicted one.
+	check(get("GET"), "cache get", "lookup stale", "origin 500", "revalidation error",
+		"cache delete", "eviction revalidation-failed", "cache set", "store 152")
+}
+
+// recordingSpan is a Span recorded by a recordingTracer.
+type recordingSpan struct {
+	name   string
+	parent *recordingSpan
+	attrs  []Attribute
+	events []string
+	ended  *[]*recordingSpan
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attribute) { s.attrs = append(s.attrs, attrs...) }
+
+func (s *recordingSpan) AddEvent(name string, attrs ...Attribute) {
+	s.events = append(s.events, name)
+}
+
+func (s *recordingSpan) End(err error) { *s.ended = append(*s.ended, s) }
+
+type spanContextKey struct{}
+
+// recordingTracer is a Tracer keeping the spans it started, in the order
+// they ended.
+type recordingTracer struct {
+	spans []*recordingSpan
+}
+
+func (tr *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanContextKey{}).(*recordingSpan)
+	span := &recordingSpan{name: name, parent: parent, ended: &tr.spans}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func TestTracing(t *testing.T) {
+	resetTest()
+	status := http.StatusOK
+	tracer := &recordingTracer{}
+	tp := NewTransport(NewMemoryCache())
+	tp.Tracer = tracer
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Context().Value(spanContextKey{}) == nil {
+			t.Error("origin request has no span")
+		}
+		return &http.Response{
+			Status:     http.StatusText(status),
+			StatusCode: status,
+			Header: http.Header{
+				"Cache-Control": {"max-age=3600, stale-if-error=3600"},
+				"Date":          {time.Now().UTC().Format(time.RFC1123)},
+				"Etag":          {`"abc"`},
+			},
+			Body: ioutil.NopCloser(bytes.NewBufferString("some data")),
+		}, nil
+	})
+	get := func() []*recordingSpan {
+		tracer.spans = nil
+		req, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return tracer.spans
+	}
+	check := func(spans []*recordingSpan, lookup string, want ...string) {
+		t.Helper()
+		var names []string
+		var root *recordingSpan
+		for _, span := range spans {
+			names = append(names, span.name)
+			if span.name == "httpcache.RoundTrip" {
+				root = span
+			}
+		}
+		if strings.Join(names, ", ") != strings.Join(want, ", ") {
+			t.Errorf("got spans %q, want %q", names, want)
+		}
+		for _, attr := range root.attrs {
+			if attr.Key == attrLookup && attr.Value != lookup {
+				t.Errorf("got lookup %q, want %q", attr.Value, lookup)
+			}
+		}
+		for _, span := range spans {
+			if span != root && span.parent != root {
+				t.Errorf("span %s isn't a child of the RoundTrip span", span.name)
+			}
+		}
+	}
+
+	check(get(), "miss", "httpcache.cache.get", "httpcache.fetch", "httpcache.RoundTrip", "httpcache.cache.set")
+	status = http.StatusNotModified
+	check(get(), "stale", "httpcache.cache.get", "httpcache.revalidate", "httpcache.RoundTrip")
+	status = http.StatusInternalServerError
+	spans := get()
+	check(spans, "stale", "httpcache.cache.get", "httpcache.revalidate", "httpcache.RoundTrip")
+	if events := spans[len(spans)-1].events; len(events) != 1 || events[0] != "httpcache.serve_stale" {
+		t.Errorf("got events %v, want a stale serve", events)
+	}
+}
+
+func TestDecisionLogging(t *testing.T) {
+	resetTest()
+	var header http.Header
+	var buf bytes.Buffer
+	tp := NewTransport(NewMemoryCache())
+	tp.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey || a.Key == slog.LevelKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("some data")),
+		}, nil
+	})
+	get := func(explain bool, accept string) string {
+		buf.Reset()
+		req, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+		req.Header.Set("Accept", accept)
+		if explain {
+			req = req.WithContext(context.WithValue(req.Context(), LogDecisionsContextKey, true))
+		}
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		return buf.String()
+	}
+
+	header = http.Header{"Cache-Control": {"max-age=3600"}}
+	if got := get(false, "text/plain"); got != "" {
+		t.Errorf("logged %q at debug level", got)
+	}
+	want := `msg="httpcache: miss" method=GET key=http://somewhere.com/ reason="not in cache"
+msg="httpcache: not stored" method=GET key=http://somewhere.com/ reason="no validators"
+`
+	if got := get(true, "text/plain"); got != want {
+		t.Errorf("got log\n%s\nwant\n%s", got, want)
+	}
+
+	header = http.Header{"Cache-Control": {"max-age=3600"}, "Etag": {`"abc"`}, "Vary": {"Accept"}}
+	get(true, "text/plain")
+	if got := get(true, "text/html"); !strings.Contains(got, `reason="vary mismatch on Accept"`) {
+		t.Errorf("got log\n%s\nwant a vary mismatch", got)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	resetTest()
+	clock = &fakeClock{elapsed: 10 * time.Second}
+	date := time.Now().UTC().Format(time.RFC1123)
+	for _, tc := range []struct {
+		name       string
+		method     string
+		opts       *Options
+		reqHeader  http.Header
+		respHeader http.Header
+		want       Explanation
+	}{{
+		name:       "fresh for its validators",
+		reqHeader:  http.Header{"If-None-Match": {`"abc"`}},
+		respHeader: http.Header{"Date": {date}, "Cache-Control": {"max-age=60"}, "Etag": {`"abc"`}},
+		want: Explanation{
+			Cacheable: true, Storable: true, Lifetime: time.Minute, LifetimeSource: LifetimeMaxAge,
+			Age: 10 * time.Second, Freshness: "fresh", Directives: []string{"response max-age=60"}, Next: ActionServe,
+		},
+	}, {
+		name:       "stale",
+		reqHeader:  http.Header{"Cache-Control": {"stale-if-error"}},
+		respHeader: http.Header{"Date": {date}, "Expires": {date}, "Last-Modified": {date}},
+		want: Explanation{
+			Cacheable: true, Storable: true, LifetimeSource: LifetimeExpires, Age: 10 * time.Second,
+			Freshness: "stale", Directives: []string{"request stale-if-error"}, StaleIfError: true, Next: ActionRevalidate,
+		},
+	}, {
+		name:       "no validators",
+		reqHeader:  http.Header{"Cache-Control": {"only-if-cached"}},
+		respHeader: http.Header{"Cache-Control": {"max-age=60"}},
+		want: Explanation{
+			Cacheable: true, Reasons: []string{"no validators"}, LifetimeSource: LifetimeMaxAge, Freshness: "fresh",
+			Directives: []string{"request only-if-cached", "response max-age=60"}, Next: ActionGatewayTimeout,
+		},
+	}, {
+		name:       "no-store",
+		respHeader: http.Header{"Cache-Control": {"no-store"}, "Etag": {`"abc"`}},
+		want: Explanation{
+			Cacheable: true, Reasons: []string{"response has Cache-Control: no-store"}, LifetimeSource: LifetimeNone,
+			Freshness: "stale", Directives: []string{"response no-store"}, Next: ActionFetch,
+		},
+	}, {
+		name:       "post",
+		method:     "POST",
+		respHeader: http.Header{"Etag": {`"abc"`}},
+		want: Explanation{
+			Reasons: []string{"method POST"}, LifetimeSource: LifetimeNone, Freshness: "stale", Next: ActionBypass,
+		},
+	}, {
+		name:       "ttl option",
+		opts:       &Options{TTL: time.Hour},
+		reqHeader:  http.Header{"If-None-Match": {`"abc"`}},
+		respHeader: http.Header{"Date": {date}, "Cache-Control": {"max-age=0"}, "Etag": {`"abc"`}},
+		want: Explanation{
+			Cacheable: true, Storable: true, Lifetime: time.Hour, LifetimeSource: LifetimeOption,
+			Age: 10 * time.Second, Freshness: "fresh", Directives: []string{"response max-age=0"}, Next: ActionServe,
+		},
+	}} {
+		method := tc.method
+		if method == "" {
+			method = "GET"
+		}
+		req, _ := http.NewRequest(method, "http://somewhere.com/", nil)
+		if tc.reqHeader != nil {
+			req.Header = tc.reqHeader
+		}
+		if tc.opts != nil {
+			req = req.WithContext(WithOptions(req.Context(), *tc.opts))
+		}
+		got := Explain(req, &http.Response{StatusCode: http.StatusOK, Header: tc.respHeader})
+		if !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, *got, tc.want)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	resetTest()
+	fetches := 0
+	tp := NewTransport(NewMemoryCache())
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		fetches++
+		maxAge := "3600"
+		if strings.HasPrefix(req.URL.Path, "/expired") {
+			maxAge = "0"
+		}
+		return &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Cache-Control": {"max-age=" + maxAge},
+				"Date":          {time.Now().UTC().Format(time.RFC1123)},
+				"Etag":          {`"abc"`},
+			},
+			Body: ioutil.NopCloser(bytes.NewBufferString("some data")),
+		}, nil
+	})
+	get := func(path string, conditional bool, opts Options) (status, fetched int) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "http://somewhere.com"+path, nil)
+		if conditional {
+			req.Header.Set("If-None-Match", `"abc"`)
+		}
+		req = req.WithContext(WithOptions(req.Context(), opts))
+		before := fetches
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, fetches - before
+	}
+	check := func(name string, status, fetched, wantStatus, wantFetched int) {
+		t.Helper()
+		if status != wantStatus || fetched != wantFetched {
+			t.Errorf("%s: got status %d after %d fetches, want %d after %d", name, status, fetched, wantStatus, wantFetched)
+		}
+	}
+
+	status, fetched := get("/a", false, Options{CacheOnly: true})
+	check("cache only miss", status, fetched, http.StatusGatewayTimeout, 0)
+	status, fetched = get("/a", false, Options{Bypass: true})
+	check("bypass", status, fetched, http.StatusOK, 1)
+	status, fetched = get("/a", false, Options{CacheOnly: true})
+	check("cache only after bypass", status, fetched, http.StatusGatewayTimeout, 0)
+	status, fetched = get("/a", false, Options{NoStore: true})
+	check("no store", status, fetched, http.StatusOK, 1)
+	status, fetched = get("/a", false, Options{CacheOnly: true})
+	check("cache only after no store", status, fetched, http.StatusGatewayTimeout, 0)
+
+	get("/a", false, Options{})
+	status, fetched = get("/a", false, Options{CacheOnly: true})
+	check("cache only hit", status, fetched, http.StatusOK, 0)
+	status, fetched = get("/a", true, Options{})
+	check("conditional hit", status, fetched, http.StatusNotModified, 0)
+	status, fetched = get("/a", true, Options{Refresh: true})
+	check("refresh", status, fetched, http.StatusOK, 1)
+
+	status, fetched = get("/b", true, Options{Key: "http://somewhere.com/a", CacheOnly: true})
+	check("key", status, fetched, http.StatusNotModified, 0)
+
+	get("/expired", false, Options{})
+	status, fetched = get("/expired", true, Options{})
+	check("expired", status, fetched, http.StatusOK, 1)
+	status, fetched = get("/expired", true, Options{TTL: time.Hour})
+	check("ttl", status, fetched, http.StatusNotModified, 0)
+	status, fetched = get("/expired", true, Options{MaxStale: time.Hour})
+	check("max stale", status, fetched, http.StatusNotModified, 0)
+}
+
 func TestClientTimeout(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping timeout test in short mode") // Because it takes at least 3 seconds to run.
@@ -0,0 +1,101 @@
+package httpcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// EntryInfo describes a cached response.
+type EntryInfo struct {
+	Key        string
+	Method     string
+	URL        string
+	StatusCode int
+	Header     http.Header
+	// StoredAt is when the entry was written. It is zero for entries
+	// written by older versions of this package.
+	StoredAt time.Time
+	// Age is how long ago the response was generated by the origin.
+	Age time.Duration
+	// TTL is how long the response stays fresh, negative once it is stale.
+	// It is zero if the response has no Date.
+	TTL time.Duration
+	// Freshness is "fresh" if the entry can answer a request conditional on
+	// its own validators without contacting the origin, and "stale"
+	// otherwise.
+	Freshness string
+	// Size is the size of the stored entry in bytes.
+	Size int
+	// Tags are the Surrogate-Key and Cache-Tag values of the response.
+	Tags []string
+	// Invalidated reports whether the entry was soft purged.
+	Invalidated bool
+}
+
+// Inspect returns a description of the entry stored as key in c, or nil if
+// there is none. Corrupt entries are reported with an error wrapping
+// ErrCorruptEntry.
+func Inspect(c Cache, key string) (info *EntryInfo, err error) {
+	r, ok := c.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp, meta, err := readEntry(bytes.NewReader(data), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	info = &EntryInfo{
+		Key:         key,
+		Method:      meta.Method,
+		URL:         meta.URL,
+		StatusCode:  resp.StatusCode,
+		Header:      resp.Header,
+		StoredAt:    meta.StoredAt,
+		Size:        len(data),
+		Tags:        responseTags(resp.Header),
+		Invalidated: meta.Flags&flagInvalidated != 0,
+		Freshness:   FreshnessToString[stale],
+	}
+	if info.URL == "" {
+		info.URL = KeyURL(key)
+	}
+	if date, err := Date(resp.Header); err == nil {
+		info.Age = clock.since(date)
+	} else if !meta.StoredAt.IsZero() {
+		info.Age = clock.since(meta.StoredAt)
+	}
+	if expires, ok := ExpiresAt(resp.Header); ok {
+		info.TTL = time.Until(expires)
+	}
+	validators := http.Header{}
+	if etag := resp.Header.Get("Etag"); etag != "" {
+		validators.Set("If-None-Match", etag)
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		validators.Set("If-Modified-Since", lastModified)
+	}
+	if !info.Invalidated {
+		info.Freshness = FreshnessToString[getFreshness(resp.Header, validators)]
+	}
+	return info, nil
+}
+
+// Inspect returns descriptions of the cached responses for rawurl, found as
+// by PurgeURL.
+func (t *Transport) Inspect(rawurl string) (infos []*EntryInfo) {
+	for _, key := range t.urlKeys(rawurl) {
+		if info, err := Inspect(t.Cache, key); err == nil && info != nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
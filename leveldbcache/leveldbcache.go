@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // Cache is an implementation of httpcache.Cache with leveldb storage
@@ -45,6 +46,53 @@ func (c *Cache) Delete(key string) {
 	c.db.Delete([]byte(key), nil)
 }
 
+// Keys returns the keys of all entries that start with prefix
+func (c *Cache) Keys(prefix string) (keys []string) {
+	c.scan(prefix, func(key, value []byte) {
+		keys = append(keys, string(key))
+	})
+	return
+}
+
+// PurgePrefix removes all entries whose key starts with prefix and returns how
+// many were removed
+func (c *Cache) PurgePrefix(prefix string) (n int) {
+	batch := new(leveldb.Batch)
+	c.scan(prefix, func(key, value []byte) {
+		batch.Delete(key)
+	})
+	if err := c.db.Write(batch, nil); err != nil {
+		return 0
+	}
+	return batch.Len()
+}
+
+// Len returns the number of entries
+func (c *Cache) Len() (n int) {
+	c.scan("", func(key, value []byte) {
+		n++
+	})
+	return
+}
+
+// Size returns the total size of the keys and entries in bytes
+func (c *Cache) Size() (size int64) {
+	c.scan("", func(key, value []byte) {
+		size += int64(len(key) + len(value))
+	})
+	return
+}
+
+// scan calls fn for every entry whose key starts with prefix. The slices
+// passed to fn are only valid until it returns.
+func (c *Cache) scan(prefix string, fn func(key, value []byte)) {
+	iter := c.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		fn(iter.Key(), iter.Value())
+	}
+}
+
 // New returns a new Cache that will store leveldb in path
 func New(path string) (*Cache, error) {
 	cache := &Cache{}
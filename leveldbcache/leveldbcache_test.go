@@ -22,4 +22,5 @@ func TestDiskCache(t *testing.T) {
 	}
 
 	test.Cache(t, cache)
+	test.Manage(t, cache)
 }
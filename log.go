@@ -0,0 +1,36 @@
+package httpcache
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// LogDecisionsContextKey, if set on the context of a request, makes the
+// Transport log the decisions it takes for that request at info rather
+// than debug level, so that a single request can be followed without
+// enabling debug logging.
+var LogDecisionsContextKey = &contextKey{"log-decisions"}
+
+// logDecision logs that the Transport decided decision about the response
+// to req stored as key, and why.
+func (t *Transport) logDecision(req *http.Request, key, decision, reason string, attrs ...slog.Attr) {
+	if t.Logger == nil {
+		return
+	}
+	ctx := req.Context()
+	level := slog.LevelDebug
+	if ctx.Value(LogDecisionsContextKey) != nil {
+		level = slog.LevelInfo
+	}
+	if !t.Logger.Enabled(ctx, level) {
+		return
+	}
+	attrs = append([]slog.Attr{
+		slog.String("method", req.Method),
+		slog.String("key", key),
+	}, attrs...)
+	if reason != "" {
+		attrs = append(attrs, slog.String("reason", reason))
+	}
+	t.Logger.LogAttrs(ctx, level, "httpcache: "+decision, attrs...)
+}
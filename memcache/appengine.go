@@ -9,14 +9,28 @@
 package memcache
 
 import (
-	"appengine"
-	"appengine/memcache"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+// The App Engine memcache calls used by Cache. They are variables so that
+// tests can substitute a fake memcache service.
+var (
+	memcacheGet    = memcache.Get
+	memcacheSet    = memcache.Set
+	memcacheDelete = memcache.Delete
 )
 
 // Cache is an implementation of httpcache.Cache that caches responses in App
-// Engine's memcache.
+// Engine's memcache. Memcache can't enumerate its keys, so Cache doesn't
+// implement httpcache.Lister, Purger or Sizer.
 type Cache struct {
-	appengine.Context
+	context.Context
 }
 
 // cacheKey modifies an httpcache key for use in memcache.  Specifically, it
@@ -25,37 +39,48 @@ func cacheKey(key string) string {
 	return "httpcache:" + key
 }
 
+// Has returns whether key has been cached
+func (c *Cache) Has(key string) (ok bool) {
+	_, err := memcacheGet(c.Context, cacheKey(key))
+	return err == nil
+}
+
 // Get returns the response corresponding to key if present.
-func (c *Cache) Get(key string) (resp []byte, ok bool) {
-	item, err := memcache.Get(c.Context, cacheKey(key))
+func (c *Cache) Get(key string) (resp io.ReadCloser, ok bool) {
+	item, err := memcacheGet(c.Context, cacheKey(key))
 	if err != nil {
 		if err != memcache.ErrCacheMiss {
-			c.Context.Errorf("error getting cached response: %v", err)
+			log.Errorf(c.Context, "error getting cached response: %v", err)
 		}
 		return nil, false
 	}
-	return item.Value, true
+	return ioutil.NopCloser(bytes.NewReader(item.Value)), true
 }
 
 // Set saves a response to the cache as key.
-func (c *Cache) Set(key string, resp []byte) {
+func (c *Cache) Set(key string, resp io.ReadCloser) {
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		log.Errorf(c.Context, "error reading response: %v", err)
+		return
+	}
 	item := &memcache.Item{
 		Key:   cacheKey(key),
-		Value: resp,
+		Value: data,
 	}
-	if err := memcache.Set(c.Context, item); err != nil {
-		c.Context.Errorf("error caching response: %v", err)
+	if err := memcacheSet(c.Context, item); err != nil {
+		log.Errorf(c.Context, "error caching response: %v", err)
 	}
 }
 
 // Delete removes the response with key from the cache.
 func (c *Cache) Delete(key string) {
-	if err := memcache.Delete(c.Context, cacheKey(key)); err != nil {
-		c.Context.Errorf("error deleting cached response: %v", err)
+	if err := memcacheDelete(c.Context, cacheKey(key)); err != nil && err != memcache.ErrCacheMiss {
+		log.Errorf(c.Context, "error deleting cached response: %v", err)
 	}
 }
 
 // New returns a new Cache for the given context.
-func New(ctx appengine.Context) *Cache {
+func New(ctx context.Context) *Cache {
 	return &Cache{ctx}
 }
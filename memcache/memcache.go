@@ -17,7 +17,8 @@ import (
 )
 
 // Cache is an implementation of httpcache.Cache that caches responses in a
-// memcache server.
+// memcache server. Memcache can't enumerate its keys, so Cache doesn't
+// implement httpcache.Lister, Purger or Sizer.
 type Cache struct {
 	*memcache.Client
 }
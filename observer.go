@@ -0,0 +1,233 @@
+package httpcache
+
+import (
+	"net/http"
+	"time"
+)
+
+// An Observer receives events describing what a Transport does, for
+// example to export metrics. Its methods are called synchronously from
+// RoundTrip and from the purge helpers, possibly concurrently, so they must
+// be fast and safe for concurrent use. Embed NopObserver to implement only
+// some of them.
+type Observer interface {
+	// OnLookup is called with the result of every cache lookup.
+	OnLookup(LookupEvent)
+	// OnRevalidation is called when a stale response has been revalidated
+	// with the origin.
+	OnRevalidation(RevalidationEvent)
+	// OnStore is called when a response is written to the cache.
+	OnStore(StoreEvent)
+	// OnEviction is called when the Transport removes a cached response.
+	OnEviction(EvictionEvent)
+	// OnOrigin is called after every request to the origin server.
+	OnOrigin(OriginEvent)
+	// OnCache is called after every operation of the Transport on its
+	// Cache.
+	OnCache(CacheEvent)
+}
+
+// LookupResult is the outcome of a cache lookup.
+type LookupResult string
+
+// The results of a lookup.
+const (
+	// LookupHit means a fresh response was found.
+	LookupHit LookupResult = "hit"
+	// LookupStale means a response was found that must be revalidated.
+	LookupStale LookupResult = "stale"
+	// LookupTransparent means a response was found but the request
+	// directives forbid using it without contacting the origin.
+	LookupTransparent LookupResult = "transparent"
+	// LookupMiss means no response was found.
+	LookupMiss LookupResult = "miss"
+	// LookupVaryMismatch means the response found was for a request whose
+	// headers named by Vary differ.
+	LookupVaryMismatch LookupResult = "vary-mismatch"
+	// LookupCorrupt means the entry found was corrupt.
+	LookupCorrupt LookupResult = "corrupt"
+	// LookupBanned means the response found was invalidated by a ban.
+	LookupBanned LookupResult = "banned"
+	// LookupUncacheable means the request can't be answered from the cache.
+	LookupUncacheable LookupResult = "uncacheable"
+	// LookupBypass means the request skipped the cache as its Options
+	// asked.
+	LookupBypass LookupResult = "bypass"
+)
+
+// LookupEvent describes a cache lookup.
+type LookupEvent struct {
+	Key    string
+	Result LookupResult
+}
+
+// RevalidationOutcome is the outcome of revalidating a stale response.
+type RevalidationOutcome string
+
+// The outcomes of a revalidation.
+const (
+	// RevalidationNotModified means the origin confirmed the cached
+	// response.
+	RevalidationNotModified RevalidationOutcome = "not-modified"
+	// RevalidationModified means the origin sent a new response.
+	RevalidationModified RevalidationOutcome = "modified"
+	// RevalidationStaleOnError means the origin failed and the stale
+	// response was served under stale-if-error.
+	RevalidationStaleOnError RevalidationOutcome = "stale-on-error"
+	// RevalidationError means the origin failed.
+	RevalidationError RevalidationOutcome = "error"
+)
+
+// RevalidationEvent describes the revalidation of a stale response.
+type RevalidationEvent struct {
+	Key     string
+	Outcome RevalidationOutcome
+}
+
+// StoreEvent describes a response written to the cache.
+type StoreEvent struct {
+	Key string
+	// Bytes is the size of the response, headers included.
+	Bytes int
+}
+
+// EvictionReason is why the Transport removed a cached response.
+type EvictionReason string
+
+// The reasons for an eviction.
+const (
+	// EvictionUncacheable means a new response to the request can't be
+	// stored, so the old one was removed.
+	EvictionUncacheable EvictionReason = "uncacheable"
+	// EvictionRevalidationFailed means the origin answered a revalidation
+	// with an error.
+	EvictionRevalidationFailed EvictionReason = "revalidation-failed"
+	// EvictionCorrupt means the entry was corrupt.
+	EvictionCorrupt EvictionReason = "corrupt"
+	// EvictionBanned means the response was invalidated by a ban.
+	EvictionBanned EvictionReason = "banned"
+	// EvictionPurge means the response was purged.
+	EvictionPurge EvictionReason = "purge"
+)
+
+// EvictionEvent describes a cached response removed by the Transport.
+type EvictionEvent struct {
+	Key    string
+	Reason EvictionReason
+}
+
+// OriginEvent describes a request to the origin server.
+type OriginEvent struct {
+	Key string
+	// Duration is how long the request took until the response headers
+	// were received.
+	Duration time.Duration
+	// StatusCode is the status of the response, or zero if Err is set.
+	StatusCode int
+	Err        error
+}
+
+// CacheOperation is an operation on a Cache.
+type CacheOperation string
+
+// The operations on a Cache.
+const (
+	CacheGet    CacheOperation = "get"
+	CacheSet    CacheOperation = "set"
+	CacheDelete CacheOperation = "delete"
+)
+
+// CacheEvent describes an operation on the Cache of a Transport.
+type CacheEvent struct {
+	Operation CacheOperation
+	Key       string
+	// Duration is how long the Cache took to return. For a get, it doesn't
+	// include reading the entry.
+	Duration time.Duration
+}
+
+// NopObserver is an Observer that ignores all events.
+type NopObserver struct{}
+
+// OnLookup implements Observer.
+func (NopObserver) OnLookup(LookupEvent) {}
+
+// OnRevalidation implements Observer.
+func (NopObserver) OnRevalidation(RevalidationEvent) {}
+
+// OnStore implements Observer.
+func (NopObserver) OnStore(StoreEvent) {}
+
+// OnEviction implements Observer.
+func (NopObserver) OnEviction(EvictionEvent) {}
+
+// OnOrigin implements Observer.
+func (NopObserver) OnOrigin(OriginEvent) {}
+
+// OnCache implements Observer.
+func (NopObserver) OnCache(CacheEvent) {}
+
+func (t *Transport) observeLookup(key string, result LookupResult) {
+	if t.Observer != nil {
+		t.Observer.OnLookup(LookupEvent{Key: key, Result: result})
+	}
+}
+
+func (t *Transport) observeRevalidation(key string, outcome RevalidationOutcome) {
+	if t.Observer != nil {
+		t.Observer.OnRevalidation(RevalidationEvent{Key: key, Outcome: outcome})
+	}
+}
+
+func (t *Transport) observeStore(key string, bytes int) {
+	if t.Observer != nil {
+		t.Observer.OnStore(StoreEvent{Key: key, Bytes: bytes})
+	}
+}
+
+func (t *Transport) observeEviction(key string, reason EvictionReason) {
+	if t.Observer != nil {
+		t.Observer.OnEviction(EvictionEvent{Key: key, Reason: reason})
+	}
+}
+
+// observeCache reports the operation op on key, which started at start.
+func (t *Transport) observeCache(op CacheOperation, key string, start time.Time) {
+	if t.Observer != nil {
+		t.Observer.OnCache(CacheEvent{Operation: op, Key: key, Duration: time.Since(start)})
+	}
+}
+
+// evict removes the cached response with key and reports it.
+func (t *Transport) evict(key string, reason EvictionReason) {
+	t.delete(key)
+	t.observeEviction(key, reason)
+}
+
+// fetch sends req to the origin with transport and reports and traces it.
+// start is when the request was sent.
+func (t *Transport) fetch(transport http.RoundTripper, req *http.Request, key string, revalidation bool) (resp *http.Response, start time.Time, err error) {
+	name := "httpcache.fetch"
+	if revalidation {
+		name = "httpcache.revalidate"
+	}
+	ctx, span := t.startSpan(req.Context(), name)
+	if t.Tracer != nil {
+		span.SetAttributes(Attribute{attrKey, key}, Attribute{attrMethod, req.Method}, Attribute{attrURL, req.URL.String()})
+		req = req.WithContext(ctx)
+	}
+	start = time.Now()
+	resp, err = transport.RoundTrip(req)
+	if err == nil && t.Tracer != nil {
+		span.SetAttributes(Attribute{attrStatus, resp.StatusCode})
+	}
+	span.End(err)
+	if t.Observer != nil {
+		e := OriginEvent{Key: key, Duration: time.Since(start), Err: err}
+		if err == nil {
+			e.StatusCode = resp.StatusCode
+		}
+		t.Observer.OnOrigin(e)
+	}
+	return resp, start, err
+}
@@ -0,0 +1,54 @@
+package httpcache
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Options change how a Transport handles a single request. They are
+// attached to the request's context with WithOptions and, unlike
+// Cache-Control request directives, aren't sent to the origin.
+type Options struct {
+	// Bypass sends the request to the origin without looking it up in the
+	// cache or storing the response.
+	Bypass bool
+	// Refresh ignores any cached response, sends the request to the origin
+	// unconditionally and stores the response.
+	Refresh bool
+	// CacheOnly never contacts the origin: the request is answered from the
+	// cache if a usable response is stored, and with a 504 Gateway Timeout
+	// otherwise.
+	CacheOnly bool
+	// TTL, if positive, replaces the freshness lifetime the origin assigned
+	// to the cached response.
+	TTL time.Duration
+	// Key, if set, is used in place of the request URL in the cache key.
+	Key string
+	// NoStore leaves the cache unchanged by the response.
+	NoStore bool
+	// MaxStale, if positive, accepts a cached response that has been stale
+	// for no longer than MaxStale, like the max-stale directive.
+	MaxStale time.Duration
+}
+
+// optionsContextKey is the context key of the Options of a request.
+var optionsContextKey = &contextKey{"options"}
+
+// WithOptions returns a copy of ctx that carries opts, for the request made
+// with it.
+func WithOptions(ctx context.Context, opts Options) context.Context {
+	return context.WithValue(ctx, optionsContextKey, opts)
+}
+
+// OptionsFromContext returns the Options carried by ctx, if any.
+func OptionsFromContext(ctx context.Context) (opts Options, ok bool) {
+	opts, ok = ctx.Value(optionsContextKey).(Options)
+	return
+}
+
+// requestOptions returns the Options of req, or zero Options if it has none.
+func requestOptions(req *http.Request) Options {
+	opts, _ := OptionsFromContext(req.Context())
+	return opts
+}
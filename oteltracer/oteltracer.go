@@ -0,0 +1,72 @@
+// Package oteltracer provides an httpcache.Tracer that records the spans of
+// a Transport with OpenTelemetry.
+package oteltracer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mchtech/httpcache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans.
+const tracerName = "github.com/mchtech/httpcache"
+
+// Tracer is an implementation of httpcache.Tracer that starts OpenTelemetry
+// spans.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// Start implements httpcache.Tracer.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, httpcache.Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, spanAdapter{span}
+}
+
+// spanAdapter is an httpcache.Span recorded in an OpenTelemetry span.
+type spanAdapter struct {
+	span trace.Span
+}
+
+func (s spanAdapter) SetAttributes(attrs ...httpcache.Attribute) {
+	s.span.SetAttributes(convert(attrs)...)
+}
+
+func (s spanAdapter) AddEvent(name string, attrs ...httpcache.Attribute) {
+	s.span.AddEvent(name, trace.WithAttributes(convert(attrs)...))
+}
+
+func (s spanAdapter) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+// convert returns attrs as OpenTelemetry attributes.
+func convert(attrs []httpcache.Attribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, len(attrs))
+	for i, a := range attrs {
+		switch v := a.Value.(type) {
+		case string:
+			kvs[i] = attribute.String(a.Key, v)
+		case bool:
+			kvs[i] = attribute.Bool(a.Key, v)
+		case int:
+			kvs[i] = attribute.Int(a.Key, v)
+		default:
+			kvs[i] = attribute.String(a.Key, fmt.Sprint(v))
+		}
+	}
+	return kvs
+}
+
+// New returns a Tracer starting spans with a tracer of tp.
+func New(tp trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: tp.Tracer(tracerName)}
+}
@@ -0,0 +1,65 @@
+package oteltracer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/mchtech/httpcache"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestTracer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := httpcache.NewTransport(httpcache.NewMemoryCache())
+	tp.Tracer = New(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if !trace.SpanContextFromContext(req.Context()).IsValid() {
+			t.Error("origin request has no span context")
+		}
+		return &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=3600"}, "Etag": {`"abc"`}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString("some data")),
+		}, nil
+	})
+
+	req, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	resp, err := tp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	spans := exporter.GetSpans()
+	var root tracetest.SpanStub
+	for _, span := range spans {
+		if span.Name == "httpcache.RoundTrip" {
+			root = span
+		}
+	}
+	if len(spans) != 4 || !root.SpanContext.IsValid() {
+		t.Fatalf("got %d spans, root %q", len(spans), root.Name)
+	}
+	for _, span := range spans {
+		if span.Name != root.Name && span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("span %s isn't a child of the RoundTrip span", span.Name)
+		}
+	}
+	attrs := map[string]string{}
+	for _, kv := range root.Attributes {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["httpcache.lookup"] != "miss" || attrs["httpcache.stored"] != "true" || attrs["http.response.status_code"] != "200" {
+		t.Errorf("got attributes %v", attrs)
+	}
+}
@@ -0,0 +1,115 @@
+// Package promobserver provides an httpcache.Observer that exports the
+// events of a Transport as Prometheus metrics:
+//
+//	httpcache_lookups_total{result}
+//	httpcache_revalidations_total{outcome}
+//	httpcache_stores_total
+//	httpcache_stored_bytes_total
+//	httpcache_evictions_total{reason}
+//	httpcache_origin_request_duration_seconds{code}
+//	httpcache_origin_errors_total
+//	httpcache_cache_operation_duration_seconds{operation}
+package promobserver
+
+import (
+	"strconv"
+
+	"github.com/mchtech/httpcache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Observer is an implementation of httpcache.Observer that updates
+// Prometheus metrics.
+type Observer struct {
+	lookups        *prometheus.CounterVec
+	revalidations  *prometheus.CounterVec
+	stores         prometheus.Counter
+	storedBytes    prometheus.Counter
+	evictions      *prometheus.CounterVec
+	originDuration *prometheus.HistogramVec
+	originErrors   prometheus.Counter
+	cacheDuration  *prometheus.HistogramVec
+}
+
+// OnLookup implements httpcache.Observer.
+func (o *Observer) OnLookup(e httpcache.LookupEvent) {
+	o.lookups.WithLabelValues(string(e.Result)).Inc()
+}
+
+// OnRevalidation implements httpcache.Observer.
+func (o *Observer) OnRevalidation(e httpcache.RevalidationEvent) {
+	o.revalidations.WithLabelValues(string(e.Outcome)).Inc()
+}
+
+// OnStore implements httpcache.Observer.
+func (o *Observer) OnStore(e httpcache.StoreEvent) {
+	o.stores.Inc()
+	o.storedBytes.Add(float64(e.Bytes))
+}
+
+// OnEviction implements httpcache.Observer.
+func (o *Observer) OnEviction(e httpcache.EvictionEvent) {
+	o.evictions.WithLabelValues(string(e.Reason)).Inc()
+}
+
+// OnOrigin implements httpcache.Observer.
+func (o *Observer) OnOrigin(e httpcache.OriginEvent) {
+	if e.Err != nil {
+		o.originErrors.Inc()
+		return
+	}
+	o.originDuration.WithLabelValues(strconv.Itoa(e.StatusCode)).Observe(e.Duration.Seconds())
+}
+
+// OnCache implements httpcache.Observer.
+func (o *Observer) OnCache(e httpcache.CacheEvent) {
+	o.cacheDuration.WithLabelValues(string(e.Operation)).Observe(e.Duration.Seconds())
+}
+
+// New returns an Observer whose metrics are registered with reg.
+func New(reg prometheus.Registerer) (*Observer, error) {
+	o := &Observer{
+		lookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "httpcache_lookups_total",
+			Help: "Cache lookups by result.",
+		}, []string{"result"}),
+		revalidations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "httpcache_revalidations_total",
+			Help: "Revalidations of stale responses by outcome.",
+		}, []string{"outcome"}),
+		stores: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "httpcache_stores_total",
+			Help: "Responses written to the cache.",
+		}),
+		storedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "httpcache_stored_bytes_total",
+			Help: "Bytes of the responses written to the cache.",
+		}),
+		evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "httpcache_evictions_total",
+			Help: "Cached responses removed by reason.",
+		}, []string{"reason"}),
+		originDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "httpcache_origin_request_duration_seconds",
+			Help:    "Duration of the requests to the origin by status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"code"}),
+		originErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "httpcache_origin_errors_total",
+			Help: "Requests to the origin that failed.",
+		}),
+		cacheDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "httpcache_cache_operation_duration_seconds",
+			Help:    "Duration of the operations on the cache by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+	}
+	for _, c := range []prometheus.Collector{
+		o.lookups, o.revalidations, o.stores, o.storedBytes, o.evictions, o.originDuration, o.originErrors, o.cacheDuration,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
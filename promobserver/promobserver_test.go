@@ -0,0 +1,54 @@
+package promobserver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mchtech/httpcache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserver(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	o, err := New(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.OnLookup(httpcache.LookupEvent{Result: httpcache.LookupHit})
+	o.OnLookup(httpcache.LookupEvent{Result: httpcache.LookupHit})
+	o.OnRevalidation(httpcache.RevalidationEvent{Outcome: httpcache.RevalidationModified})
+	o.OnStore(httpcache.StoreEvent{Bytes: 100})
+	o.OnEviction(httpcache.EvictionEvent{Reason: httpcache.EvictionBanned})
+	o.OnOrigin(httpcache.OriginEvent{Duration: time.Second, StatusCode: 200})
+	o.OnOrigin(httpcache.OriginEvent{Err: errors.New("unreachable")})
+	o.OnCache(httpcache.CacheEvent{Operation: httpcache.CacheGet, Duration: time.Millisecond})
+	o.OnCache(httpcache.CacheEvent{Operation: httpcache.CacheSet, Duration: time.Millisecond})
+
+	for _, c := range []struct {
+		collector prometheus.Collector
+		want      float64
+	}{
+		{o.lookups.WithLabelValues("hit"), 2},
+		{o.revalidations.WithLabelValues("modified"), 1},
+		{o.stores, 1},
+		{o.storedBytes, 100},
+		{o.evictions.WithLabelValues("banned"), 1},
+		{o.originErrors, 1},
+	} {
+		if got := testutil.ToFloat64(c.collector); got != c.want {
+			t.Errorf("got %v, want %v", got, c.want)
+		}
+	}
+	if n := testutil.CollectAndCount(o.originDuration); n != 1 {
+		t.Errorf("got %d origin duration series, want 1", n)
+	}
+	if n := testutil.CollectAndCount(o.cacheDuration); n != 2 {
+		t.Errorf("got %d cache duration series, want 2", n)
+	}
+
+	if _, err := New(reg); err == nil {
+		t.Error("registering the metrics twice succeeded")
+	}
+}
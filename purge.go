@@ -0,0 +1,124 @@
+package httpcache
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// ErrNotSupported is returned by the Transport purge helpers when its Cache
+// can't enumerate or purge its entries.
+var ErrNotSupported = errors.New("httpcache: operation not supported by cache")
+
+// urlKeyPrefixes returns the prefixes of the keys CacheKey gives to the
+// cacheable requests for URLs starting with u.
+func urlKeyPrefixes(u string) []string {
+	return []string{u, "HEAD " + u}
+}
+
+// isRangeSuffix reports whether s is the suffix CacheKey appends to the key
+// of a Range request stored with CacheRangeContextKey, such as
+// "-bytes=0-99".
+func isRangeSuffix(s string) bool {
+	if !strings.HasPrefix(s, "-") {
+		return false
+	}
+	i := strings.IndexByte(s, '=')
+	if i < 2 {
+		return false
+	}
+	for _, r := range s[1:i] {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// PurgeURL removes the cached responses for rawurl and returns how many
+// were removed. Responses that vary are stored under a single key per URL,
+// so every variant is removed. Responses to Range requests are only found
+// if the Cache is a Lister.
+func (t *Transport) PurgeURL(rawurl string) (n int) {
+	for _, key := range t.urlKeys(rawurl) {
+		t.evict(key, EvictionPurge)
+		n++
+	}
+	return n
+}
+
+// SoftPurgeURL marks the cached responses for rawurl as stale, like
+// SoftPurge, and returns how many were marked. It finds the same responses
+// as PurgeURL.
+func (t *Transport) SoftPurgeURL(rawurl string) (n int) {
+	for _, key := range t.urlKeys(rawurl) {
+		if SoftPurge(t.Cache, key) {
+			n++
+		}
+	}
+	return n
+}
+
+// urlKeys returns the keys of the cached responses for rawurl.
+func (t *Transport) urlKeys(rawurl string) (keys []string) {
+	if u, err := url.Parse(rawurl); err == nil {
+		rawurl = u.String()
+	}
+	l, isLister := t.Cache.(Lister)
+	for _, prefix := range urlKeyPrefixes(rawurl) {
+		if !isLister {
+			if t.Cache.Has(prefix) {
+				keys = append(keys, prefix)
+			}
+			continue
+		}
+		for _, key := range l.Keys(prefix) {
+			if key == prefix || isRangeSuffix(key[len(prefix):]) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// PurgePrefix removes the cached responses for all URLs that start with
+// prefix and returns how many were removed. The Cache must be a Purger or a
+// Lister; otherwise ErrNotSupported is returned.
+// Responses removed through a Purger aren't reported to the Observer.
+func (t *Transport) PurgePrefix(prefix string) (n int, err error) {
+	switch c := t.Cache.(type) {
+	case Purger:
+		for _, p := range urlKeyPrefixes(prefix) {
+			n += c.PurgePrefix(p)
+		}
+	case Lister:
+		for _, p := range urlKeyPrefixes(prefix) {
+			for _, key := range c.Keys(p) {
+				t.evict(key, EvictionPurge)
+				n++
+			}
+		}
+	default:
+		return 0, ErrNotSupported
+	}
+	return n, nil
+}
+
+// PurgeHost removes the cached responses for all http and https URLs of
+// host, which includes the port if it isn't the default one, and returns how
+// many were removed. Like PurgePrefix, it needs a Cache that is a Purger or
+// a Lister.
+func (t *Transport) PurgeHost(host string) (n int, err error) {
+	for _, scheme := range []string{"http", "https"} {
+		origin := scheme + "://" + host
+		for _, prefix := range []string{origin + "/", origin + "?"} {
+			purged, err := t.PurgePrefix(prefix)
+			if err != nil {
+				return n, err
+			}
+			n += purged
+		}
+		n += t.PurgeURL(origin)
+	}
+	return n, nil
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"strings"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/mchtech/httpcache"
@@ -52,6 +53,65 @@ func (c cache) Delete(key string) {
 	c.Do("DEL", cacheKey(key))
 }
 
+// Keys returns the keys of all entries that start with prefix. It scans the
+// server's keyspace, so it shouldn't be called on hot paths.
+func (c cache) Keys(prefix string) (keys []string) {
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", cacheKey(globEscape(prefix))+"*", "COUNT", 1000))
+		if err != nil {
+			return keys
+		}
+		var batch []string
+		if _, err := redis.Scan(values, &cursor, &batch); err != nil {
+			return keys
+		}
+		for _, key := range batch {
+			keys = append(keys, strings.TrimPrefix(key, cacheKey("")))
+		}
+		if cursor == 0 {
+			return keys
+		}
+	}
+}
+
+// PurgePrefix removes all entries whose key starts with prefix and returns
+// how many were removed.
+func (c cache) PurgePrefix(prefix string) (n int) {
+	for _, key := range c.Keys(prefix) {
+		deleted, _ := redis.Int(c.Do("DEL", cacheKey(key)))
+		n += deleted
+	}
+	return n
+}
+
+// Len returns the number of entries.
+func (c cache) Len() (n int) {
+	return len(c.Keys(""))
+}
+
+// Size returns the total size of the keys and entries in bytes.
+func (c cache) Size() (size int64) {
+	for _, key := range c.Keys("") {
+		n, _ := redis.Int64(c.Do("STRLEN", cacheKey(key)))
+		size += int64(len(key)) + n
+	}
+	return size
+}
+
+// globEscape escapes the characters that are special in redis glob patterns.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 // NewWithClient returns a new Cache with the given redis connection.
 func NewWithClient(client redis.Conn) httpcache.Cache {
 	return cache{client}
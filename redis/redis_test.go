@@ -3,6 +3,7 @@ package redis
 import (
 	"testing"
 
+	"github.com/alicebob/miniredis"
 	"github.com/gomodule/redigo/redis"
 	"github.com/mchtech/httpcache/test"
 )
@@ -10,10 +11,26 @@ import (
 func TestRedisCache(t *testing.T) {
 	conn, err := redis.Dial("tcp", "localhost:6379")
 	if err != nil {
-		// TODO: rather than skip the test, fall back to a faked redis server
-		t.Skipf("skipping test; no server running at localhost:6379")
+		// No server running at localhost:6379; fall back to a fake one.
+		s, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if conn, err = redis.Dial("tcp", s.Addr()); err != nil {
+			t.Fatal(err)
+		}
 	}
 	conn.Do("FLUSHALL")
 
-	test.Cache(t, NewWithClient(conn))
+	cache := NewWithClient(conn)
+	test.Cache(t, cache)
+	test.Manage(t, cache.(test.ManagedCache))
+	test.Tags(t, cache)
+}
+
+func TestGlobEscape(t *testing.T) {
+	if got := globEscape("http://a/*?[x]\\"); got != `http://a/\*\?\[x\]\\` {
+		t.Fatalf("globEscape() = %q", got)
+	}
 }
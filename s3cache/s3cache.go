@@ -0,0 +1,255 @@
+// Package s3cache provides an implementation of httpcache.Cache that stores
+// responses in an S3-compatible object store using
+// github.com/minio/minio-go/v7
+//
+// Entries are streamed to the store in a multipart upload, so large
+// responses are never held in memory. Each object is named
+// <prefix><host>/<sha256 of key>, which lets lifecycle rules expire the
+// whole cache or a single host, and carries the cache key and the response's
+// freshness as object metadata:
+//
+//	X-Amz-Meta-Httpcache-Key      the cache key, query-escaped
+//	X-Amz-Meta-Httpcache-Stored   when the entry was stored, RFC 3339
+//	X-Amz-Meta-Httpcache-Expires  when the response stops being fresh, RFC 3339
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mchtech/httpcache"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// DefaultPartSize is the size of the parts entries are uploaded in when
+	// Options.PartSize is zero. It is the smallest part size S3 accepts.
+	DefaultPartSize = 5 * 1024 * 1024
+
+	// maxHeadSize limits how much of an entry is buffered to read the
+	// response headers for the object metadata.
+	maxHeadSize = 64 * 1024
+
+	// contentType is the content type of the stored objects.
+	contentType = "message/http"
+)
+
+// Object metadata keys, without the X-Amz-Meta- prefix.
+const (
+	metaKey     = "Httpcache-Key"
+	metaStored  = "Httpcache-Stored"
+	metaExpires = "Httpcache-Expires"
+)
+
+// Options configures a Cache.
+type Options struct {
+	// Bucket is the bucket objects are stored in. It must already exist.
+	Bucket string
+	// Prefix is prepended to all object names, for example "httpcache/".
+	Prefix string
+	// PartSize is the size of the parts of the multipart uploads. Defaults
+	// to DefaultPartSize.
+	PartSize uint64
+	// ListMetadata reads the keys of entries from object listings, which
+	// saves a HEAD request per object in Keys and PurgePrefix. Only MinIO
+	// servers include object metadata in listings.
+	ListMetadata bool
+}
+
+// Cache is an implementation of httpcache.Cache that stores responses in an
+// S3-compatible object store.
+type Cache struct {
+	client *minio.Client
+	opts   Options
+}
+
+// Has returns whether key has been cached
+func (c *Cache) Has(key string) (ok bool) {
+	_, err := c.client.StatObject(context.Background(), c.opts.Bucket, c.objectName(key), minio.StatObjectOptions{})
+	return err == nil
+}
+
+// Get returns the response corresponding to key if present. The response is
+// streamed from the store as it is read.
+func (c *Cache) Get(key string) (resp io.ReadCloser, ok bool) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext is Get with the requests to the store made with ctx.
+func (c *Cache) GetContext(ctx context.Context, key string) (resp io.ReadCloser, ok bool) {
+	obj, err := c.client.GetObject(ctx, c.opts.Bucket, c.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, false
+	}
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, false
+	}
+	return obj, true
+}
+
+// Set saves a response to the cache as key
+func (c *Cache) Set(key string, resp io.ReadCloser) {
+	c.SetContext(context.Background(), key, resp)
+}
+
+// SetContext is Set with the requests to the store made with ctx.
+func (c *Cache) SetContext(ctx context.Context, key string, resp io.ReadCloser) {
+	head, err := readHead(resp)
+	if err != nil && err != io.EOF {
+		return
+	}
+	meta := map[string]string{
+		metaKey:    url.QueryEscape(key),
+		metaStored: time.Now().UTC().Format(time.RFC3339),
+	}
+	if r, err := httpcache.ReadEntryHeader(bytes.NewReader(head)); err == nil {
+		if expires, ok := httpcache.ExpiresAt(r.Header); ok {
+			meta[metaExpires] = expires.UTC().Format(time.RFC3339)
+		}
+	}
+
+	partSize := c.opts.PartSize
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	}
+	c.client.PutObject(ctx, c.opts.Bucket, c.objectName(key),
+		io.MultiReader(bytes.NewReader(head), resp), -1,
+		minio.PutObjectOptions{
+			UserMetadata: meta,
+			ContentType:  contentType,
+			PartSize:     partSize,
+		})
+}
+
+// Delete removes the response with key from the cache
+func (c *Cache) Delete(key string) {
+	c.client.RemoveObject(context.Background(), c.opts.Bucket, c.objectName(key), minio.RemoveObjectOptions{})
+}
+
+// Keys returns the keys of all entries that start with prefix. Prefixes
+// that name a host are listed from that host's objects only; others list
+// the whole cache.
+func (c *Cache) Keys(prefix string) (keys []string) {
+	c.scan(prefix, true, func(key string, obj minio.ObjectInfo) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// PurgePrefix removes all entries whose key starts with prefix and returns
+// how many were removed.
+func (c *Cache) PurgePrefix(prefix string) (n int) {
+	c.scan(prefix, prefix != "", func(key string, obj minio.ObjectInfo) {
+		if c.client.RemoveObject(context.Background(), c.opts.Bucket, obj.Key, minio.RemoveObjectOptions{}) == nil {
+			n++
+		}
+	})
+	return n
+}
+
+// Len returns the number of entries.
+func (c *Cache) Len() (n int) {
+	c.scan("", false, func(key string, obj minio.ObjectInfo) {
+		n++
+	})
+	return n
+}
+
+// Size returns the total size of the entries in bytes. The keys are kept in
+// the object metadata and aren't counted.
+func (c *Cache) Size() (size int64) {
+	c.scan("", false, func(key string, obj minio.ObjectInfo) {
+		size += obj.Size
+	})
+	return size
+}
+
+// scan calls fn for every object holding an entry whose key starts with
+// prefix. If needKey is false and prefix is empty, the objects are only
+// listed and fn is called with an empty key. Otherwise the keys are read
+// from the object metadata, with a HEAD request per object unless
+// ListMetadata is set.
+func (c *Cache) scan(prefix string, needKey bool, fn func(key string, obj minio.ObjectInfo)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := c.client.ListObjects(ctx, c.opts.Bucket, minio.ListObjectsOptions{
+		Prefix:       c.opts.Prefix + prefixHost(prefix),
+		Recursive:    true,
+		WithMetadata: c.opts.ListMetadata,
+	})
+	for obj := range objects {
+		if obj.Err != nil {
+			return
+		}
+		if !needKey && prefix == "" {
+			fn("", obj)
+			continue
+		}
+		escaped, ok := obj.UserMetadataStripped[metaKey]
+		if !ok {
+			info, err := c.client.StatObject(ctx, c.opts.Bucket, obj.Key, minio.StatObjectOptions{})
+			if err != nil {
+				continue
+			}
+			escaped = info.UserMetadata[metaKey]
+		}
+		key, err := url.QueryUnescape(escaped)
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		fn(key, obj)
+	}
+}
+
+// prefixHost returns the object name prefix of the host that all keys
+// starting with prefix belong to, or "" if prefix doesn't determine the
+// host.
+func prefixHost(prefix string) string {
+	u := httpcache.KeyURL(prefix)
+	i := strings.Index(u, "://")
+	if i < 0 {
+		return ""
+	}
+	rest := u[i+len("://"):]
+	j := strings.IndexAny(rest, "/?#")
+	if j <= 0 {
+		return ""
+	}
+	return rest[:j] + "/"
+}
+
+// objectName returns the name of the object key is stored in.
+func (c *Cache) objectName(key string) string {
+	var host string
+	if u, err := url.Parse(httpcache.KeyURL(key)); err == nil {
+		host = u.Host
+	}
+	if host == "" {
+		host = "_"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return c.opts.Prefix + host + "/" + hex.EncodeToString(sum[:])
+}
+
+// readHead reads up to maxHeadSize bytes of an entry from r, which is
+// enough to hold its headers.
+func readHead(r io.Reader) (head []byte, err error) {
+	head = make([]byte, maxHeadSize)
+	n, err := io.ReadFull(r, head)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return head[:n], err
+}
+
+// New returns a new Cache that stores objects with the given client.
+func New(client *minio.Client, opts Options) *Cache {
+	return &Cache{client: client, opts: opts}
+}
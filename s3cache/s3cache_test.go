@@ -0,0 +1,124 @@
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/mchtech/httpcache/test"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// newFakeS3 returns a client for an in-process fake S3 server with an empty
+// bucket named "cache". The server uses TLS, as minio-go signs streamed
+// uploads chunk by chunk over plain HTTP, which the fake doesn't decode. If
+// heads isn't nil, it counts the HEAD requests the server receives.
+func newFakeS3(t *testing.T, heads *int32) (client *minio.Client, closeFn func()) {
+	handler := gofakes3.New(s3mem.New()).Server()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if heads != nil && r.Method == "HEAD" {
+			atomic.AddInt32(heads, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	u, _ := url.Parse(server.URL)
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4("key", "secret", ""),
+		Secure:       true,
+		Transport:    server.Client().Transport,
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.MakeBucket(context.Background(), "cache", minio.MakeBucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return client, server.Close
+}
+
+func TestS3Cache(t *testing.T) {
+	client, closeFn := newFakeS3(t, nil)
+	defer closeFn()
+
+	cache := New(client, Options{Bucket: "cache", Prefix: "httpcache/"})
+	test.Cache(t, cache)
+	test.Manage(t, cache)
+}
+
+func TestS3CacheListing(t *testing.T) {
+	var heads int32
+	client, closeFn := newFakeS3(t, &heads)
+	defer closeFn()
+	cache := New(client, Options{Bucket: "cache", Prefix: "httpcache/"})
+	for _, key := range []string{"http://a.example.com/1", "http://b.example.com/1"} {
+		cache.Set(key, ioutil.NopCloser(strings.NewReader("entry")))
+	}
+
+	atomic.StoreInt32(&heads, 0)
+	if n := cache.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want 2", n)
+	}
+	if size := cache.Size(); size != 10 {
+		t.Fatalf("Size() = %d, want 10", size)
+	}
+	if n := cache.PurgePrefix(""); n != 2 {
+		t.Fatalf("PurgePrefix() removed %d entries, want 2", n)
+	}
+	if n := atomic.LoadInt32(&heads); n != 0 {
+		t.Fatalf("listing made %d HEAD requests, want 0", n)
+	}
+}
+
+func TestS3CacheMetadata(t *testing.T) {
+	client, closeFn := newFakeS3(t, nil)
+	defer closeFn()
+	cache := New(client, Options{Bucket: "cache", Prefix: "httpcache/"})
+
+	date := time.Now().UTC().Truncate(time.Second)
+	body := bytes.Repeat([]byte("x"), DefaultPartSize+1)
+	entry := "HTTP/1.1 200 OK\r\n" +
+		"Date: " + date.Format(time.RFC1123) + "\r\n" +
+		"Cache-Control: max-age=60\r\n" +
+		"Content-Length: 5242881\r\n\r\n" + string(body)
+	key := "http://example.com/large"
+	cache.Set(key, ioutil.NopCloser(strings.NewReader(entry)))
+
+	name := cache.objectName(key)
+	if !strings.HasPrefix(name, "httpcache/example.com/") {
+		t.Fatalf("object name %q doesn't start with prefix and host", name)
+	}
+	info, err := client.StatObject(context.Background(), "cache", name, minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.UserMetadata[metaExpires], date.Add(time.Minute).Format(time.RFC3339); got != want {
+		t.Errorf("expires metadata = %q, want %q", got, want)
+	}
+	if got := info.UserMetadata[metaKey]; got != url.QueryEscape(key) {
+		t.Errorf("key metadata = %q", got)
+	}
+
+	resp, ok := cache.Get(key)
+	if !ok {
+		t.Fatal("could not retrieve an element we just added")
+	}
+	defer resp.Close()
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != entry {
+		t.Fatalf("retrieved %d bytes, want %d", len(data), len(entry))
+	}
+}
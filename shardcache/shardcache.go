@@ -0,0 +1,412 @@
+// Package shardcache provides an implementation of httpcache.Cache that
+// distributes entries over several underlying caches, such as a number of
+// redis or memcache servers or several disks.
+//
+// Each key is owned by the node that ranks highest for it under weighted
+// rendezvous hashing. Adding or removing a node therefore only moves the keys
+// that node gains or loses, and a node that is ejected as unhealthy only
+// hands its own keys to their next ranked node until it recovers. Deletes and
+// purges that an ejected node misses are recorded and applied to it before it
+// is restored. Past 10000 of them, the node is flushed instead if it is
+// an httpcache.Purger or httpcache.Lister; other nodes may then serve entries
+// deleted during the outage until they expire.
+package shardcache
+
+import (
+	"hash/fnv"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mchtech/httpcache"
+)
+
+// A Node is one of the caches entries are distributed over.
+type Node struct {
+	// Name identifies the node for hashing. It must be unique and should be
+	// stable, such as the address of the server, as renaming a node moves
+	// its keys.
+	Name string
+	// Cache stores the entries owned by the node.
+	Cache httpcache.Cache
+	// Weight is the share of keys the node owns relative to the other nodes.
+	// Defaults to 1.
+	Weight float64
+}
+
+// Options configures a Cache.
+type Options struct {
+	// HealthCheck reports whether a node is healthy. It is called for every
+	// node each HealthInterval; nodes it fails are ejected until it passes
+	// again.
+	HealthCheck func(node Node) bool
+	// HealthInterval is how often HealthCheck is run. Defaults to 10 seconds.
+	HealthInterval time.Duration
+}
+
+// maxMissed is the number of deletes and purges recorded for an ejected
+// node, beyond which it is flushed when restored.
+const maxMissed = 10000
+
+type node struct {
+	Node
+	healthy bool
+	// missedKeys and missedPrefixes are the deletes and purges made while
+	// the node was ejected, and missedAll is set when there were too many
+	// of them to record.
+	missedKeys     map[string]bool
+	missedPrefixes []string
+	missedAll      bool
+}
+
+// missDelete records a delete of key made while n was ejected.
+func (n *node) missDelete(key string) {
+	if n.missedAll {
+		return
+	}
+	if n.missedKeys == nil {
+		n.missedKeys = map[string]bool{}
+	}
+	n.missedKeys[key] = true
+	n.checkMissed()
+}
+
+// missPurge records a purge of prefix made while n was ejected.
+func (n *node) missPurge(prefix string) {
+	if n.missedAll {
+		return
+	}
+	n.missedPrefixes = append(n.missedPrefixes, prefix)
+	n.checkMissed()
+}
+
+// checkMissed switches n to being flushed once too many deletes and purges
+// have been recorded.
+func (n *node) checkMissed() {
+	if len(n.missedKeys)+len(n.missedPrefixes) > maxMissed {
+		n.missedKeys, n.missedPrefixes, n.missedAll = nil, nil, true
+	}
+}
+
+// flush removes all entries from n, if it is a Purger or a Lister.
+func (n *node) flush() {
+	switch c := n.Cache.(type) {
+	case httpcache.Purger:
+		c.PurgePrefix("")
+	case httpcache.Lister:
+		for _, key := range c.Keys("") {
+			n.Cache.Delete(key)
+		}
+	}
+}
+
+// Cache is an implementation of httpcache.Cache that shards entries over
+// several caches.
+type Cache struct {
+	mu    sync.RWMutex
+	nodes []*node
+	opts  Options
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// Has returns whether key has been cached
+func (c *Cache) Has(key string) (ok bool) {
+	if n := c.owner(key); n != nil {
+		return n.Has(key)
+	}
+	return false
+}
+
+// Get returns the response corresponding to key if present
+func (c *Cache) Get(key string) (resp io.ReadCloser, ok bool) {
+	if n := c.owner(key); n != nil {
+		return n.Get(key)
+	}
+	return nil, false
+}
+
+// Set saves a response to the cache as key
+func (c *Cache) Set(key string, resp io.ReadCloser) {
+	if n := c.owner(key); n != nil {
+		n.Set(key, resp)
+	}
+}
+
+// Delete removes the response with key from every node, so that a copy
+// stored while another node owned the key can't be served later. Ejected
+// nodes are updated when they are restored.
+func (c *Cache) Delete(key string) {
+	var nodes []Node
+	c.mu.Lock()
+	for _, n := range c.nodes {
+		if n.healthy {
+			nodes = append(nodes, n.Node)
+			continue
+		}
+		n.missDelete(key)
+	}
+	c.mu.Unlock()
+	for _, n := range nodes {
+		n.Cache.Delete(key)
+	}
+}
+
+// Keys returns the keys of all entries that start with prefix, from the
+// healthy nodes that are httpcache.Listers. Copies left on nodes that no
+// longer own their key are left out.
+func (c *Cache) Keys(prefix string) (keys []string) {
+	for _, n := range c.healthyNodes() {
+		l, ok := n.Cache.(httpcache.Lister)
+		if !ok {
+			continue
+		}
+		for _, key := range l.Keys(prefix) {
+			c.mu.RLock()
+			owner := c.ownerLocked(key)
+			c.mu.RUnlock()
+			if owner != nil && owner.Name == n.Name {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// PurgePrefix removes all entries whose key starts with prefix from the
+// nodes that are httpcache.Purgers and returns how many were removed from
+// the healthy ones, counting copies left on nodes that no longer own their
+// key. Ejected nodes are purged when they are restored.
+func (c *Cache) PurgePrefix(prefix string) (n int) {
+	var nodes []Node
+	c.mu.Lock()
+	for _, node := range c.nodes {
+		if _, ok := node.Cache.(httpcache.Purger); !ok {
+			continue
+		}
+		if node.healthy {
+			nodes = append(nodes, node.Node)
+		} else {
+			node.missPurge(prefix)
+		}
+	}
+	c.mu.Unlock()
+	for _, node := range nodes {
+		n += node.Cache.(httpcache.Purger).PurgePrefix(prefix)
+	}
+	return n
+}
+
+// Len returns the total number of entries on the healthy nodes that are
+// httpcache.Sizers.
+func (c *Cache) Len() (n int) {
+	for _, node := range c.healthyNodes() {
+		if s, ok := node.Cache.(httpcache.Sizer); ok {
+			n += s.Len()
+		}
+	}
+	return n
+}
+
+// Size returns the total size of the keys and entries in bytes on the
+// healthy nodes that are httpcache.Sizers.
+func (c *Cache) Size() (size int64) {
+	for _, node := range c.healthyNodes() {
+		if s, ok := node.Cache.(httpcache.Sizer); ok {
+			size += s.Size()
+		}
+	}
+	return size
+}
+
+// Add adds node to the cache, replacing any node of the same name.
+func (c *Cache) Add(node Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(node.Name)
+	c.nodes = append(c.nodes, newNode(node))
+}
+
+// Remove removes the node called name from the cache.
+func (c *Cache) Remove(name string) {
+	c.mu.Lock()
+	c.removeLocked(name)
+	c.mu.Unlock()
+}
+
+// SetHealthy ejects the node called name from the cache, or restores it
+// once the deletes and purges it missed have been applied.
+func (c *Cache) SetHealthy(name string, healthy bool) {
+	for {
+		c.mu.Lock()
+		var n *node
+		for _, nn := range c.nodes {
+			if nn.Name == name {
+				n = nn
+			}
+		}
+		if n == nil || !healthy || n.healthy || (len(n.missedKeys) == 0 && len(n.missedPrefixes) == 0 && !n.missedAll) {
+			if n != nil {
+				n.healthy = healthy
+			}
+			c.mu.Unlock()
+			return
+		}
+		keys, prefixes, all := n.missedKeys, n.missedPrefixes, n.missedAll
+		n.missedKeys, n.missedPrefixes, n.missedAll = nil, nil, false
+		c.mu.Unlock()
+
+		// Deletes and purges made meanwhile are recorded again and
+		// applied in the next round.
+		if all {
+			n.flush()
+			continue
+		}
+		for key := range keys {
+			n.Cache.Delete(key)
+		}
+		for _, prefix := range prefixes {
+			n.Cache.(httpcache.Purger).PurgePrefix(prefix)
+		}
+	}
+}
+
+// Node returns the node that owns key, and false if no node is healthy.
+func (c *Cache) Node(key string) (node Node, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if n := c.ownerLocked(key); n != nil {
+		return n.Node, true
+	}
+	return Node{}, false
+}
+
+// Close stops the health checks.
+func (c *Cache) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.wg.Wait()
+	})
+	return nil
+}
+
+// healthyNodes returns the nodes currently in use.
+func (c *Cache) healthyNodes() (nodes []Node) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, n := range c.nodes {
+		if n.healthy {
+			nodes = append(nodes, n.Node)
+		}
+	}
+	return nodes
+}
+
+func (c *Cache) owner(key string) httpcache.Cache {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if n := c.ownerLocked(key); n != nil {
+		return n.Cache
+	}
+	return nil
+}
+
+// ownerLocked returns the healthy node with the highest rendezvous score for
+// key, or nil if there is none.
+func (c *Cache) ownerLocked(key string) (owner *node) {
+	best := math.Inf(-1)
+	for _, n := range c.nodes {
+		if !n.healthy {
+			continue
+		}
+		if s := score(n.Name, n.Weight, key); s > best {
+			best, owner = s, n
+		}
+	}
+	return
+}
+
+func (c *Cache) removeLocked(name string) {
+	for i, n := range c.nodes {
+		if n.Name == name {
+			c.nodes = append(c.nodes[:i], c.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *Cache) checkHealth() {
+	defer c.wg.Done()
+	interval := c.opts.HealthInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mu.RLock()
+		nodes := make([]Node, len(c.nodes))
+		for i, n := range c.nodes {
+			nodes[i] = n.Node
+		}
+		c.mu.RUnlock()
+		for _, n := range nodes {
+			c.SetHealthy(n.Name, c.opts.HealthCheck(n))
+		}
+	}
+}
+
+// score returns the weighted rendezvous score of the node called name for key.
+func score(name string, weight float64, key string) float64 {
+	h := fnv.New64a()
+	io.WriteString(h, name)
+	h.Write([]byte{0})
+	io.WriteString(h, key)
+	// Map the mixed hash to a uniform value in (0, 1).
+	u := (float64(mix(h.Sum64())>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+// mix is the splitmix64 finalizer, which spreads the bits of FNV's output.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func newNode(n Node) *node {
+	if n.Weight <= 0 {
+		n.Weight = 1
+	}
+	return &node{Node: n, healthy: true}
+}
+
+// New returns a Cache that shards entries over nodes.
+func New(nodes ...Node) *Cache {
+	return NewWithOptions(Options{}, nodes...)
+}
+
+// NewWithOptions returns a Cache that shards entries over nodes, configured
+// by opts. If health checks are started, they run until Close is called.
+func NewWithOptions(opts Options, nodes ...Node) *Cache {
+	c := &Cache{opts: opts, done: make(chan struct{})}
+	for _, n := range nodes {
+		c.Add(n)
+	}
+	if opts.HealthCheck != nil {
+		c.wg.Add(1)
+		go c.checkHealth()
+	}
+	return c
+}
@@ -0,0 +1,108 @@
+package shardcache
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mchtech/httpcache"
+	"github.com/mchtech/httpcache/test"
+)
+
+func newNodes(names ...string) (nodes []Node) {
+	for _, name := range names {
+		nodes = append(nodes, Node{Name: name, Cache: httpcache.NewMemoryCache()})
+	}
+	return
+}
+
+func TestShardCache(t *testing.T) {
+	test.Cache(t, New(newNodes("a", "b", "c")...))
+	test.Manage(t, New(newNodes("a", "b", "c")...))
+}
+
+func TestShardCacheDistribution(t *testing.T) {
+	c := New(newNodes("a", "b", "c")...)
+	const keys = 3000
+	owners := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < keys; i++ {
+		key := "http://example.com/" + strconv.Itoa(i)
+		n, _ := c.Node(key)
+		owners[key] = n.Name
+		counts[n.Name]++
+	}
+	for name, count := range counts {
+		if count < keys/3*8/10 || count > keys/3*12/10 {
+			t.Errorf("node %s owns %d of %d keys", name, count, keys)
+		}
+	}
+
+	c.Add(Node{Name: "d", Cache: httpcache.NewMemoryCache(), Weight: 2})
+	moved := 0
+	for key, owner := range owners {
+		n, _ := c.Node(key)
+		if n.Name != owner {
+			if n.Name != "d" {
+				t.Fatalf("key %s moved from %s to %s instead of the new node", key, owner, n.Name)
+			}
+			moved++
+		}
+	}
+	// The new node has weight 2 out of 5, so it should take about 40% of the keys.
+	if moved < keys*35/100 || moved > keys*45/100 {
+		t.Errorf("%d of %d keys moved to the new node", moved, keys)
+	}
+
+	c.SetHealthy("d", false)
+	for key, owner := range owners {
+		if n, _ := c.Node(key); n.Name != owner {
+			t.Fatalf("key %s owned by %s after ejection, want %s", key, n.Name, owner)
+		}
+	}
+}
+
+func TestShardCacheEjectedDelete(t *testing.T) {
+	c := New(newNodes("a", "b", "c")...)
+	const key, other = "http://example.com/a", "http://example.com/b"
+	c.Set(key, io.NopCloser(strings.NewReader("value")))
+	c.Set(other, io.NopCloser(strings.NewReader("value")))
+	owner, _ := c.Node(key)
+	otherOwner, _ := c.Node(other)
+
+	c.SetHealthy(owner.Name, false)
+	c.SetHealthy(otherOwner.Name, false)
+	c.Delete(key)
+	c.PurgePrefix(other)
+	c.SetHealthy(owner.Name, true)
+	c.SetHealthy(otherOwner.Name, true)
+
+	if _, ok := owner.Cache.Get(key); ok {
+		t.Errorf("key deleted while its node was ejected is back on %s", owner.Name)
+	}
+	if _, ok := otherOwner.Cache.Get(other); ok {
+		t.Errorf("key purged while its node was ejected is back on %s", otherOwner.Name)
+	}
+	if _, ok := c.Get(key); ok {
+		t.Error("deleted key served after its node recovered")
+	}
+
+	// Past maxMissed deletes, the node is flushed instead.
+	c.Set(key, io.NopCloser(strings.NewReader("value")))
+	c.SetHealthy(owner.Name, false)
+	for i := 0; i <= maxMissed; i++ {
+		c.Delete("http://example.com/missed/" + strconv.Itoa(i))
+	}
+	c.mu.RLock()
+	for _, n := range c.nodes {
+		if n.Name == owner.Name && (len(n.missedKeys) != 0 || !n.missedAll) {
+			t.Errorf("%d missed deletes recorded past the limit", len(n.missedKeys))
+		}
+	}
+	c.mu.RUnlock()
+	c.SetHealthy(owner.Name, true)
+	if _, ok := owner.Cache.Get(key); ok {
+		t.Error("node not flushed after too many missed deletes")
+	}
+}
@@ -0,0 +1,190 @@
+// Package sqlitecache provides an implementation of httpcache.Cache that
+// stores responses in a SQLite database using the pure-Go modernc.org/sqlite
+// driver.
+//
+// Next to each response the table records its URL, host, status, when it was
+// stored, when it stops being fresh, its size and its ETag, so the cache can
+// be inspected and maintained with plain SQL, for example from the sqlite3
+// command line:
+//
+//	SELECT url, size FROM httpcache ORDER BY size DESC LIMIT 10;
+//	DELETE FROM httpcache WHERE host = 'api.example.com';
+//
+// Times are stored as Unix seconds.
+package sqlitecache
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	"github.com/mchtech/httpcache"
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// Table is the name of the table entries are stored in.
+const Table = "httpcache"
+
+const schema = `
+CREATE TABLE IF NOT EXISTS ` + Table + ` (
+	key        TEXT PRIMARY KEY,
+	url        TEXT NOT NULL,
+	host       TEXT NOT NULL,
+	status     INTEGER NOT NULL,
+	stored_at  INTEGER NOT NULL,
+	expires_at INTEGER,
+	size       INTEGER NOT NULL,
+	etag       TEXT NOT NULL,
+	response   BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS ` + Table + `_host ON ` + Table + ` (host);
+CREATE INDEX IF NOT EXISTS ` + Table + `_expires_at ON ` + Table + ` (expires_at);
+CREATE INDEX IF NOT EXISTS ` + Table + `_size ON ` + Table + ` (size);
+`
+
+// Cache is an implementation of httpcache.Cache with SQLite storage
+type Cache struct {
+	db *sql.DB
+}
+
+// Has returns whether key has been cached
+func (c *Cache) Has(key string) (ok bool) {
+	var one int
+	err := c.db.QueryRow(`SELECT 1 FROM `+Table+` WHERE key = ?`, key).Scan(&one)
+	return err == nil
+}
+
+// Get returns the response corresponding to key if present
+func (c *Cache) Get(key string) (resp io.ReadCloser, ok bool) {
+	var data []byte
+	err := c.db.QueryRow(`SELECT response FROM `+Table+` WHERE key = ?`, key).Scan(&data)
+	if err != nil {
+		return nil, false
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), true
+}
+
+// Set saves a response to the cache as key
+func (c *Cache) Set(key string, resp io.ReadCloser) {
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		return
+	}
+	rawURL := httpcache.KeyURL(key)
+	var host, etag string
+	var status int
+	var expiresAt sql.NullInt64
+	if u, err := url.Parse(rawURL); err == nil {
+		host = u.Hostname()
+	}
+	if r, err := httpcache.ReadEntryHeader(bytes.NewReader(data)); err == nil {
+		status = r.StatusCode
+		etag = r.Header.Get("Etag")
+		if expires, ok := httpcache.ExpiresAt(r.Header); ok {
+			expiresAt = sql.NullInt64{Int64: expires.Unix(), Valid: true}
+		}
+	}
+	c.db.Exec(`INSERT OR REPLACE INTO `+Table+`
+		(key, url, host, status, stored_at, expires_at, size, etag, response)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		key, rawURL, host, status, time.Now().Unix(), expiresAt, len(data), etag, data)
+}
+
+// Delete removes the response with key from the cache
+func (c *Cache) Delete(key string) {
+	c.db.Exec(`DELETE FROM `+Table+` WHERE key = ?`, key)
+}
+
+// Keys returns the keys of all entries that start with prefix
+func (c *Cache) Keys(prefix string) (keys []string) {
+	rows, err := c.db.Query(`SELECT key FROM `+Table+` WHERE substr(key, 1, ?) = ?`, len(prefix), prefix)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		if rows.Scan(&key) == nil {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// PurgePrefix removes all entries whose key starts with prefix and returns how
+// many were removed
+func (c *Cache) PurgePrefix(prefix string) (n int) {
+	return c.exec(`DELETE FROM `+Table+` WHERE substr(key, 1, ?) = ?`, len(prefix), prefix)
+}
+
+// PurgeHost removes all entries for URLs on host and returns how many were
+// removed
+func (c *Cache) PurgeHost(host string) (n int) {
+	return c.exec(`DELETE FROM `+Table+` WHERE host = ?`, host)
+}
+
+// PurgeExpired removes all entries that stopped being fresh before t, and
+// those without a Date stored before t, and returns how many were removed.
+// Passing a time in the past keeps stale entries around for revalidation.
+func (c *Cache) PurgeExpired(t time.Time) (n int) {
+	return c.exec(`DELETE FROM `+Table+` WHERE expires_at < ?1 OR (expires_at IS NULL AND stored_at < ?1)`, t.Unix())
+}
+
+// Len returns the number of entries
+func (c *Cache) Len() (n int) {
+	c.db.QueryRow(`SELECT count(*) FROM ` + Table).Scan(&n)
+	return
+}
+
+// Size returns the total size of the keys and entries in bytes
+func (c *Cache) Size() (size int64) {
+	c.db.QueryRow(`SELECT coalesce(sum(length(key) + size), 0) FROM ` + Table).Scan(&size)
+	return
+}
+
+// DB returns the underlying database, for queries on the entry metadata.
+func (c *Cache) DB() *sql.DB {
+	return c.db
+}
+
+// Close closes the underlying database.
+func (c *Cache) Close() error {
+	return c.db.Close()
+}
+
+func (c *Cache) exec(query string, args ...interface{}) (n int) {
+	res, err := c.db.Exec(query, args...)
+	if err != nil {
+		return 0
+	}
+	affected, _ := res.RowsAffected()
+	return int(affected)
+}
+
+// New returns a new Cache that will store its SQLite database in path
+func New(path string) (*Cache, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serialising access avoids busy errors.
+	db.SetMaxOpenConns(1)
+	cache, err := NewWithDB(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return cache, nil
+}
+
+// NewWithDB returns a new Cache using the provided SQLite database as
+// underlying storage, creating its table if needed.
+func NewWithDB(db *sql.DB) (*Cache, error) {
+	if _, err := db.Exec(schema); err != nil {
+		return nil, err
+	}
+	return &Cache{db}, nil
+}
@@ -0,0 +1,71 @@
+package sqlitecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mchtech/httpcache/test"
+)
+
+func TestSQLiteCache(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache, err := New(filepath.Join(tempDir, "cache.db"))
+	if err != nil {
+		t.Fatalf("New sqlite: %v", err)
+	}
+	defer cache.Close()
+
+	test.Cache(t, cache)
+	test.Manage(t, cache)
+}
+
+func TestSQLiteCacheMetadata(t *testing.T) {
+	cache, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New sqlite: %v", err)
+	}
+	defer cache.Close()
+
+	date := time.Now().UTC().Truncate(time.Second)
+	entry := func(etag string, maxAge int) string {
+		return "HTTP/1.1 200 OK\r\n" +
+			"Date: " + date.Format(time.RFC1123) + "\r\n" +
+			"Cache-Control: max-age=" + strings.Repeat("9", maxAge) + "\r\n" +
+			"Etag: " + etag + "\r\n" +
+			"Content-Length: 0\r\n\r\n"
+	}
+	cache.Set("http://a.example.com/x", ioutil.NopCloser(strings.NewReader(entry(`"x"`, 1))))
+	cache.Set("HEAD http://a.example.com/y", ioutil.NopCloser(strings.NewReader(entry(`"y"`, 6))))
+	cache.Set("http://b.example.com/z", ioutil.NopCloser(strings.NewReader(entry(`"z"`, 6))))
+
+	var url, host, etag string
+	var status int
+	var expiresAt int64
+	err = cache.DB().QueryRow(`SELECT url, host, status, etag, expires_at FROM httpcache WHERE key = ?`,
+		"HEAD http://a.example.com/y").Scan(&url, &host, &status, &etag, &expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "http://a.example.com/y" || host != "a.example.com" || status != 200 || etag != `"y"` {
+		t.Fatalf("got url %q, host %q, status %d, etag %q", url, host, status, etag)
+	}
+	if want := date.Add(999999 * time.Second).Unix(); expiresAt != want {
+		t.Fatalf("expires_at = %d, want %d", expiresAt, want)
+	}
+
+	if n := cache.PurgeExpired(date.Add(time.Minute)); n != 1 || cache.Has("http://a.example.com/x") {
+		t.Fatalf("PurgeExpired removed %d entries", n)
+	}
+	if n := cache.PurgeHost("a.example.com"); n != 1 || cache.Len() != 1 {
+		t.Fatalf("PurgeHost removed %d entries", n)
+	}
+}
@@ -0,0 +1,190 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseTags returns the tags of a response: the space separated
+// Surrogate-Key values and the comma separated Cache-Tag values.
+func responseTags(h http.Header) (tags []string) {
+	seen := map[string]bool{}
+	add := func(tag string) {
+		if tag = strings.TrimSpace(tag); tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, v := range h.Values("Surrogate-Key") {
+		for _, tag := range strings.Fields(v) {
+			add(tag)
+		}
+	}
+	for _, v := range h.Values("Cache-Tag") {
+		for _, tag := range strings.Split(v, ",") {
+			add(tag)
+		}
+	}
+	return tags
+}
+
+// Keys in the TagIndex. The index holds an empty entry keyed by
+// tagIndexPrefix, the tag, a NUL byte and the key of every tagged response,
+// so that the keys of a tag are listed by prefix and indexing a response
+// doesn't rewrite the list of its tag. It also holds the tags of every
+// indexed response, keyed by keyIndexPrefix and its key, so that they are
+// known when the response is replaced or removed.
+const (
+	tagIndexPrefix = "tag:"
+	keyIndexPrefix = "key:"
+)
+
+// tagLockStripes is the number of locks the index updates of a Transport
+// are spread over by key.
+const tagLockStripes = 64
+
+// tagLock returns the lock serializing the index updates for key.
+func (t *Transport) tagLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	io.WriteString(h, key)
+	return &t.tagMu[h.Sum32()%tagLockStripes]
+}
+
+// store saves entry, the response tagged with tags, to the cache as key.
+func (t *Transport) store(ctx context.Context, key string, entry io.ReadCloser, tags []string) {
+	ctx, span := t.startSpan(ctx, "httpcache.cache.set")
+	defer span.End(nil)
+	if t.Tracer != nil {
+		span.SetAttributes(Attribute{attrKey, key})
+	}
+	start := time.Now()
+	cacheSet(ctx, t.Cache, key, entry)
+	t.observeCache(CacheSet, key, start)
+	if t.TagIndex != nil {
+		mu := t.tagLock(key)
+		mu.Lock()
+		t.retag(key, tags)
+		mu.Unlock()
+	}
+}
+
+// delete removes the response with key from the cache.
+func (t *Transport) delete(key string) {
+	start := time.Now()
+	t.Cache.Delete(key)
+	t.observeCache(CacheDelete, key, start)
+	if t.TagIndex != nil && t.TagIndex.Has(keyIndexPrefix+key) {
+		mu := t.tagLock(key)
+		mu.Lock()
+		t.retag(key, nil)
+		mu.Unlock()
+	}
+}
+
+// PurgeTag removes the cached responses tagged with tag by their
+// Surrogate-Key or Cache-Tag header and returns how many were removed. Only
+// responses stored while TagIndex was set are found, and TagIndex must be a
+// Lister.
+func (t *Transport) PurgeTag(tag string) (n int) {
+	l, ok := t.TagIndex.(Lister)
+	if !ok {
+		return 0
+	}
+	prefix := tagIndexPrefix + tag + "\x00"
+	for _, indexKey := range l.Keys(prefix) {
+		key := indexKey[len(prefix):]
+		mu := t.tagLock(key)
+		mu.Lock()
+		// The index may be outdated if the entry was replaced or removed
+		// other than through t, so check the entry still has the tag.
+		if containsString(t.entryTags(key), tag) {
+			t.Cache.Delete(key)
+			t.retag(key, nil)
+			t.observeEviction(key, EvictionPurge)
+			n++
+		} else {
+			t.retag(key, removeString(t.indexedTags(key), tag))
+		}
+		mu.Unlock()
+	}
+	return n
+}
+
+// retag moves key from the indexes of the tags it is indexed under to those
+// of tags. The lock of key must be held.
+func (t *Transport) retag(key string, tags []string) {
+	old := t.indexedTags(key)
+	for _, tag := range old {
+		if !containsString(tags, tag) {
+			t.TagIndex.Delete(tagIndexPrefix + tag + "\x00" + key)
+		}
+	}
+	for _, tag := range tags {
+		if !containsString(old, tag) {
+			t.TagIndex.Set(tagIndexPrefix+tag+"\x00"+key, ioutil.NopCloser(bytes.NewReader(nil)))
+		}
+	}
+	switch {
+	case len(tags) == 0 && len(old) > 0:
+		t.TagIndex.Delete(keyIndexPrefix + key)
+	case len(tags) > 0 && strings.Join(tags, "\n") != strings.Join(old, "\n"):
+		t.TagIndex.Set(keyIndexPrefix+key, ioutil.NopCloser(strings.NewReader(strings.Join(tags, "\n"))))
+	}
+}
+
+// indexedTags returns the tags key is indexed under.
+func (t *Transport) indexedTags(key string) []string {
+	r, ok := t.TagIndex.Get(keyIndexPrefix + key)
+	if !ok {
+		return nil
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	return strings.Split(string(data), "\n")
+}
+
+// entryTags returns the tags of the response stored as key.
+func (t *Transport) entryTags(key string) []string {
+	r, ok := t.Cache.Get(key)
+	if !ok {
+		return nil
+	}
+	defer r.Close()
+	resp, meta, err := readEntryHeader(r)
+	if err != nil {
+		return nil
+	}
+	if len(meta.Tags) > 0 {
+		return meta.Tags
+	}
+	return responseTags(resp.Header)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	out := list[:0]
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -3,6 +3,11 @@ package test
 import (
 	"bytes"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/mchtech/httpcache"
@@ -50,3 +55,128 @@ func Cache(t *testing.T, cache httpcache.Cache) {
 		t.Fatal("deleted key still present")
 	}
 }
+
+// ManagedCache is a Cache that supports enumeration, purging and size
+// statistics.
+type ManagedCache interface {
+	httpcache.Cache
+	httpcache.Lister
+	httpcache.Purger
+	httpcache.Sizer
+}
+
+// Manage excercises the Lister, Purger and Sizer extensions of a
+// httpcache.Cache implementation.
+func Manage(t *testing.T, cache ManagedCache) {
+	if n := cache.Len(); n != 0 {
+		t.Fatalf("empty cache has %d entries", n)
+	}
+
+	entries := map[string]string{
+		"http://a.example.com/1": "one",
+		"http://a.example.com/2": "two",
+		"http://b.example.com/1": "three",
+	}
+	var size, valuesSize int64
+	for key, val := range entries {
+		cache.Set(key, ioutil.NopCloser(strings.NewReader(val)))
+		size += int64(len(key) + len(val))
+		valuesSize += int64(len(val))
+	}
+
+	if n := cache.Len(); n != len(entries) {
+		t.Fatalf("Len() = %d, want %d", n, len(entries))
+	}
+	if got := cache.Size(); got != size && got != valuesSize {
+		t.Fatalf("Size() = %d, want %d", got, size)
+	}
+
+	keys := cache.Keys("http://a.example.com/")
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "http://a.example.com/1" || keys[1] != "http://a.example.com/2" {
+		t.Fatalf("Keys() = %q", keys)
+	}
+
+	if n := cache.PurgePrefix("http://a.example.com/"); n != 2 {
+		t.Fatalf("PurgePrefix() removed %d entries, want 2", n)
+	}
+	if cache.Has("http://a.example.com/1") || cache.Has("http://a.example.com/2") {
+		t.Fatal("purged key still present")
+	}
+	if !cache.Has("http://b.example.com/1") {
+		t.Fatal("key outside the purged prefix was removed")
+	}
+	if keys := cache.Keys(""); len(keys) != 1 {
+		t.Fatalf("Keys() after purge = %q", keys)
+	}
+
+	cache.Delete("http://b.example.com/1")
+}
+
+// Tags excercises the tag index of a httpcache.Transport storing responses
+// in a httpcache.Cache implementation.
+func Tags(t *testing.T, cache httpcache.Cache) {
+	var mu sync.Mutex
+	headers := map[string]http.Header{
+		"/a": {"Surrogate-Key": {"red blue"}},
+		"/b": {"Cache-Tag": {"blue"}},
+		"/c": {"Cache-Tag": {"red"}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"etag"`)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		mu.Lock()
+		for k, v := range headers[r.URL.Path] {
+			w.Header()[k] = v
+		}
+		mu.Unlock()
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	tp := httpcache.NewTransport(cache)
+	tp.TagIndex = httpcache.NewMemoryCache()
+	get := func(path string, refresh bool) {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		if refresh {
+			req.Header.Set("Cache-Control", "no-cache")
+		}
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		get(path, false)
+	}
+
+	// Overwriting an entry moves it to its new tags.
+	mu.Lock()
+	headers["/c"] = http.Header{"Cache-Tag": {"green"}}
+	mu.Unlock()
+	get("/c", true)
+
+	if n := tp.PurgeTag("red"); n != 1 {
+		t.Fatalf("PurgeTag(red) removed %d entries, want 1", n)
+	}
+	if cache.Has(server.URL+"/a") || !cache.Has(server.URL+"/c") {
+		t.Fatal("PurgeTag(red) removed the wrong entries")
+	}
+	if n := tp.PurgeTag("blue"); n != 1 || cache.Has(server.URL+"/b") {
+		t.Fatalf("PurgeTag(blue) removed %d entries, want /b", n)
+	}
+
+	// Removing an entry removes it from the index.
+	mu.Lock()
+	headers["/c"].Set("Cache-Control", "no-store")
+	mu.Unlock()
+	get("/c", true)
+	if cache.Has(server.URL + "/c") {
+		t.Fatal("uncacheable response still cached")
+	}
+	if n := tp.PurgeTag("green"); n != 0 {
+		t.Fatalf("PurgeTag(green) removed %d entries after the entry was deleted", n)
+	}
+}
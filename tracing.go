@@ -0,0 +1,76 @@
+package httpcache
+
+import (
+	"context"
+	"io"
+)
+
+// A Tracer starts the spans a Transport traces RoundTrip, the cache lookups
+// and stores, and the requests to the origin with. The oteltracer module
+// provides one for OpenTelemetry.
+type Tracer interface {
+	// Start starts a span called name as a child of the span in ctx, if
+	// any, and returns a copy of ctx carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// A Span is an operation traced by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	AddEvent(name string, attrs ...Attribute)
+	// End ends the span, recording err as its failure if it isn't nil.
+	End(err error)
+}
+
+// An Attribute describes a Span or one of its events. Value is a string, a
+// bool or an int.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Keys of the attributes of the spans of a Transport.
+const (
+	attrKey       = "httpcache.key"
+	attrLookup    = "httpcache.lookup"
+	attrFreshness = "httpcache.freshness"
+	attrFound     = "httpcache.found"
+	attrStored    = "httpcache.stored"
+	attrMethod    = "http.request.method"
+	attrURL       = "url.full"
+	attrStatus    = "http.response.status_code"
+	attrError     = "error"
+)
+
+// nopSpan is the Span of a Transport without a Tracer.
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(...Attribute)    {}
+func (nopSpan) AddEvent(string, ...Attribute) {}
+func (nopSpan) End(error)                     {}
+
+// startSpan starts a span as a child of the one in ctx, if the Transport has
+// a Tracer. Callers only build attributes when t.Tracer is set.
+func (t *Transport) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if t.Tracer == nil {
+		return ctx, nopSpan{}
+	}
+	return t.Tracer.Start(ctx, name)
+}
+
+// cacheGet gets key from c, passing ctx on if c is a ContextCache.
+func cacheGet(ctx context.Context, c Cache, key string) (io.ReadCloser, bool) {
+	if cc, ok := c.(ContextCache); ok {
+		return cc.GetContext(ctx, key)
+	}
+	return c.Get(key)
+}
+
+// cacheSet sets key in c, passing ctx on if c is a ContextCache.
+func cacheSet(ctx context.Context, c Cache, key string, entry io.ReadCloser) {
+	if cc, ok := c.(ContextCache); ok {
+		cc.SetContext(ctx, key, entry)
+		return
+	}
+	c.Set(key, entry)
+}
@@ -0,0 +1,275 @@
+// Package twotier provides an implementation of httpcache.Cache that combines
+// a fast first tier, such as httpcache.MemoryCache, with a slower persistent
+// second tier, such as a diskcache or redis Cache.
+//
+// Reads are served from the first tier when possible and otherwise from the
+// second, promoting what is found there to the first tier. Writes go to both
+// tiers, either synchronously or, with Options.WriteBehind, to the second tier
+// in the background.
+package twotier
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/mchtech/httpcache"
+)
+
+// Options configures a Cache.
+type Options struct {
+	// Admit decides whether an entry of size bytes is stored in the first
+	// tier. If nil, every entry is.
+	Admit func(key string, size int) bool
+	// WriteBehind makes Set and Delete return once the first tier is
+	// updated, leaving the second tier to a background writer. The Cache
+	// must then be closed with Close to flush pending writes.
+	WriteBehind bool
+	// QueueSize is the number of second tier writes that may be pending
+	// before Set and Delete block. Defaults to 1024.
+	QueueSize int
+}
+
+// MaxSize returns an Options.Admit function that only admits entries of at
+// most limit bytes to the first tier.
+func MaxSize(limit int) func(key string, size int) bool {
+	return func(key string, size int) bool {
+		return size <= limit
+	}
+}
+
+// Cache is an implementation of httpcache.Cache that stores responses in two
+// tiers.
+type Cache struct {
+	first, second httpcache.Cache
+	opts          Options
+
+	mu sync.Mutex
+	// epoch is incremented by every Set and Delete when it updates the
+	// first tier, which it does under mu once the second tier is written or
+	// the write is queued, so that a Get racing with them doesn't promote an
+	// outdated entry.
+	epoch uint64
+	// pending holds the operations queued for the second tier.
+	pending map[string]*write
+
+	queue chan *write
+	wg    sync.WaitGroup
+}
+
+// write is a second tier operation queued by write-behind.
+type write struct {
+	key  string
+	data []byte // nil for a Delete
+}
+
+// Has returns whether key has been cached
+func (c *Cache) Has(key string) (ok bool) {
+	if c.first.Has(key) {
+		return true
+	}
+	if w := c.pendingWrite(key); w != nil {
+		return w.data != nil
+	}
+	return c.second.Has(key)
+}
+
+// Get returns the response corresponding to key if present
+func (c *Cache) Get(key string) (resp io.ReadCloser, ok bool) {
+	c.mu.Lock()
+	epoch := c.epoch
+	c.mu.Unlock()
+
+	if resp, ok := c.first.Get(key); ok {
+		return resp, true
+	}
+	if w := c.pendingWrite(key); w != nil {
+		if w.data == nil {
+			// Deleted, but not yet from the second tier.
+			return nil, false
+		}
+		return ioutil.NopCloser(bytes.NewReader(w.data)), true
+	}
+
+	resp, ok = c.second.Get(key)
+	if !ok {
+		return nil, false
+	}
+	data, err := ioutil.ReadAll(resp)
+	resp.Close()
+	if err != nil {
+		return nil, false
+	}
+	if c.admit(key, data) {
+		c.mu.Lock()
+		if c.epoch == epoch {
+			c.first.Set(key, ioutil.NopCloser(bytes.NewReader(data)))
+		}
+		c.mu.Unlock()
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), true
+}
+
+// Set saves a response to the cache as key
+func (c *Cache) Set(key string, resp io.ReadCloser) {
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		return
+	}
+	if !c.opts.WriteBehind {
+		c.second.Set(key, ioutil.NopCloser(bytes.NewReader(data)))
+	}
+	w := &write{key: key, data: data}
+	c.mu.Lock()
+	c.epoch++
+	if c.admit(key, data) {
+		c.first.Set(key, ioutil.NopCloser(bytes.NewReader(data)))
+	} else {
+		// Don't leave an older version of the entry behind.
+		c.first.Delete(key)
+	}
+	if c.opts.WriteBehind {
+		c.pending[key] = w
+	}
+	c.mu.Unlock()
+	if c.opts.WriteBehind {
+		c.queue <- w
+	}
+}
+
+// Delete removes the response with key from both tiers
+func (c *Cache) Delete(key string) {
+	if !c.opts.WriteBehind {
+		c.second.Delete(key)
+	}
+	w := &write{key: key}
+	c.mu.Lock()
+	c.epoch++
+	c.first.Delete(key)
+	if c.opts.WriteBehind {
+		c.pending[key] = w
+	}
+	c.mu.Unlock()
+	if c.opts.WriteBehind {
+		c.queue <- w
+	}
+}
+
+// Keys returns the keys of all entries that start with prefix, from the
+// tiers that are httpcache.Listers and the pending second tier writes.
+func (c *Cache) Keys(prefix string) (keys []string) {
+	seen := map[string]bool{}
+	for _, tier := range []httpcache.Cache{c.second, c.first} {
+		if l, ok := tier.(httpcache.Lister); ok {
+			for _, key := range l.Keys(prefix) {
+				seen[key] = true
+			}
+		}
+	}
+	if c.opts.WriteBehind {
+		c.mu.Lock()
+		for key, w := range c.pending {
+			if strings.HasPrefix(key, prefix) {
+				seen[key] = w.data != nil || c.first.Has(key)
+			}
+		}
+		c.mu.Unlock()
+	}
+	for key, ok := range seen {
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// PurgePrefix removes all entries whose key starts with prefix from both
+// tiers and returns how many were removed.
+func (c *Cache) PurgePrefix(prefix string) (n int) {
+	for _, key := range c.Keys(prefix) {
+		c.Delete(key)
+		n++
+	}
+	return n
+}
+
+// Len returns the number of entries.
+func (c *Cache) Len() (n int) {
+	return len(c.Keys(""))
+}
+
+// Size returns the total size of the keys and entries in bytes in the second
+// tier, which holds every entry once the pending writes are done, if it is
+// an httpcache.Sizer.
+func (c *Cache) Size() (size int64) {
+	if s, ok := c.second.(httpcache.Sizer); ok {
+		return s.Size()
+	}
+	return 0
+}
+
+// Close waits for the pending second tier writes. The Cache must not be used
+// afterwards.
+func (c *Cache) Close() error {
+	if c.queue != nil {
+		close(c.queue)
+		c.wg.Wait()
+	}
+	return nil
+}
+
+func (c *Cache) admit(key string, data []byte) bool {
+	return c.opts.Admit == nil || c.opts.Admit(key, len(data))
+}
+
+// pendingWrite returns the last operation on key still queued for the
+// second tier, or nil if there is none.
+func (c *Cache) pendingWrite(key string) *write {
+	if !c.opts.WriteBehind {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pending[key]
+}
+
+// writeBehind applies the queued operations to the second tier, in order.
+func (c *Cache) writeBehind() {
+	defer c.wg.Done()
+	for w := range c.queue {
+		if w.data != nil {
+			c.second.Set(w.key, ioutil.NopCloser(bytes.NewReader(w.data)))
+		} else {
+			c.second.Delete(w.key)
+		}
+		c.mu.Lock()
+		if c.pending[w.key] == w {
+			delete(c.pending, w.key)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// New returns a Cache that reads through first to second and writes through
+// to both.
+func New(first, second httpcache.Cache) *Cache {
+	return NewWithOptions(first, second, Options{})
+}
+
+// NewWithOptions returns a Cache over first and second configured by opts.
+func NewWithOptions(first, second httpcache.Cache, opts Options) *Cache {
+	c := &Cache{first: first, second: second, opts: opts}
+	if opts.WriteBehind {
+		size := opts.QueueSize
+		if size <= 0 {
+			size = 1024
+		}
+		c.pending = map[string]*write{}
+		c.queue = make(chan *write, size)
+		c.wg.Add(1)
+		go c.writeBehind()
+	}
+	return c
+}
@@ -0,0 +1,139 @@
+package twotier
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/mchtech/httpcache"
+	"github.com/mchtech/httpcache/test"
+)
+
+func TestTwoTier(t *testing.T) {
+	test.Cache(t, New(httpcache.NewMemoryCache(), httpcache.NewMemoryCache()))
+	test.Manage(t, New(httpcache.NewMemoryCache(), httpcache.NewMemoryCache()))
+
+	c := NewWithOptions(httpcache.NewMemoryCache(), httpcache.NewMemoryCache(), Options{WriteBehind: true})
+	test.Cache(t, c)
+	c.Close()
+}
+
+func TestTwoTierPromotion(t *testing.T) {
+	first, second := httpcache.NewMemoryCache(), httpcache.NewMemoryCache()
+	c := NewWithOptions(first, second, Options{Admit: MaxSize(5)})
+
+	c.Set("small", ioutil.NopCloser(strings.NewReader("tiny")))
+	c.Set("large", ioutil.NopCloser(strings.NewReader("too large")))
+	if !first.Has("small") || first.Has("large") {
+		t.Fatal("first tier admission not applied")
+	}
+	if !second.Has("small") || !second.Has("large") {
+		t.Fatal("entries not written to second tier")
+	}
+
+	second.Set("promoted", ioutil.NopCloser(strings.NewReader("value")))
+	resp, ok := c.Get("promoted")
+	if !ok {
+		t.Fatal("second tier entry not found")
+	}
+	if data, _ := ioutil.ReadAll(resp); string(data) != "value" {
+		t.Fatalf("got %q", data)
+	}
+	if !first.Has("promoted") {
+		t.Fatal("second tier hit not promoted")
+	}
+
+	c.Delete("promoted")
+	if first.Has("promoted") || second.Has("promoted") {
+		t.Fatal("entry not deleted from both tiers")
+	}
+}
+
+func TestTwoTierWriteBehind(t *testing.T) {
+	first, second := httpcache.NewMemoryCache(), httpcache.NewMemoryCache()
+	c := NewWithOptions(first, second, Options{WriteBehind: true, Admit: MaxSize(0)})
+
+	c.Set("key", ioutil.NopCloser(strings.NewReader("value")))
+	if _, ok := c.Get("key"); !ok {
+		t.Fatal("pending entry not found")
+	}
+	c.Set("deleted", ioutil.NopCloser(strings.NewReader("value")))
+	c.Delete("deleted")
+	c.Close()
+
+	if !second.Has("key") {
+		t.Fatal("write-behind entry not flushed to second tier")
+	}
+	if second.Has("deleted") {
+		t.Fatal("deleted entry written to second tier")
+	}
+}
+
+// blockingCache is a Cache whose Set and Delete wait for release.
+type blockingCache struct {
+	httpcache.Cache
+	started, release chan struct{}
+}
+
+func (c *blockingCache) Set(key string, resp io.ReadCloser) {
+	c.started <- struct{}{}
+	<-c.release
+	c.Cache.Set(key, resp)
+}
+
+func (c *blockingCache) Delete(key string) {
+	c.started <- struct{}{}
+	<-c.release
+	c.Cache.Delete(key)
+}
+
+func newBlockingCache() *blockingCache {
+	return &blockingCache{httpcache.NewMemoryCache(), make(chan struct{}), make(chan struct{})}
+}
+
+func TestTwoTierConsistency(t *testing.T) {
+	get := func(c *Cache, key string) string {
+		resp, ok := c.Get(key)
+		if !ok {
+			return ""
+		}
+		data, _ := ioutil.ReadAll(resp)
+		return string(data)
+	}
+
+	// A Delete queued for the second tier hides the entry.
+	first, second := httpcache.NewMemoryCache(), newBlockingCache()
+	second.Cache.Set("key", ioutil.NopCloser(strings.NewReader("old")))
+	c := NewWithOptions(first, second, Options{WriteBehind: true})
+	c.Delete("key")
+	<-second.started
+	if got := get(c, "key"); got != "" || c.Has("key") {
+		t.Fatalf("got %q for an entry being deleted", got)
+	}
+	close(second.release)
+	c.Close()
+	if first.Has("key") || second.Cache.Has("key") {
+		t.Fatal("deleted entry left in a tier")
+	}
+
+	// A Get racing with a write-through Set doesn't leave the old entry in
+	// the first tier.
+	first, second = httpcache.NewMemoryCache(), newBlockingCache()
+	second.Cache.Set("key", ioutil.NopCloser(strings.NewReader("old")))
+	c = New(first, second)
+	done := make(chan struct{})
+	go func() {
+		c.Set("key", ioutil.NopCloser(strings.NewReader("new")))
+		close(done)
+	}()
+	<-second.started
+	if got := get(c, "key"); got != "old" {
+		t.Fatalf("got %q while the second tier is written", got)
+	}
+	close(second.release)
+	<-done
+	if got := get(c, "key"); got != "new" {
+		t.Fatalf("got %q after Set, want the new entry", got)
+	}
+}